@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strconv"
 	"sync"
 	"time"
 
@@ -18,6 +19,7 @@ import (
 )
 
 var kTimeout time.Duration = time.Second * 3
+var kRetryPolicy valve.RetryPolicy
 
 func main() {
 	flag_config := flag.String("config", "config.yml", "Config file path")
@@ -56,6 +58,19 @@ func main() {
 		}
 	}
 
+	// Get the retry policy. Retrying keeps packet loss from being counted as
+	// dead servers.
+	if retriesStr, err := cfg.Get("retries"); err == nil {
+		if retries, err := strconv.Atoi(retriesStr); err == nil {
+			kRetryPolicy.Attempts = retries + 1
+		}
+	}
+	if backoffStr, err := cfg.Get("retry_backoff"); err == nil {
+		if backoff, err := time.ParseDuration(backoffStr); err == nil {
+			kRetryPolicy.Backoff = backoff
+		}
+	}
+
 	// Get a database connection.
 	db := getDatabase(cfg, "database")
 	defer db.Close()
@@ -88,6 +88,7 @@ func queryServer(addr *net.TCPAddr) (*Server, error) {
 		return nil, err
 	}
 	defer query.Close()
+	query.SetRetryPolicy(kRetryPolicy)
 
 	info, err := query.QueryInfo()
 	if err != nil {
@@ -5,6 +5,10 @@
 // See LICENSE.txt for more details.
 package batch
 
+import (
+	"sync/atomic"
+)
+
 // A batch is a list of arbitrary items.
 type Batch interface {
 	Item(index int) interface{}
@@ -28,6 +32,11 @@ type BatchProcessor struct {
 	// These are only modified from the process goroutine.
 	worklist    []interface{} // Pending items to create tasks for.
 	outstanding int           // Number of remaining tasks we're waiting on.
+
+	// Copies of len(worklist) and outstanding for Stats(), which can be read
+	// from any goroutine.
+	numQueued  int64
+	numRunning int64
 }
 
 // Create a new batch processor.
@@ -63,6 +72,19 @@ func (this *BatchProcessor) AddBatch(batch Batch) {
 	this.batchQueue <- batch
 }
 
+// Returns the number of items waiting for a task, and the number of tasks
+// running. This is safe to call from any goroutine.
+func (this *BatchProcessor) Stats() (queued int, running int) {
+	return int(atomic.LoadInt64(&this.numQueued)), int(atomic.LoadInt64(&this.numRunning))
+}
+
+// This must only be invoked from the process goroutine, after changing the
+// worklist or outstanding count.
+func (this *BatchProcessor) publishStats() {
+	atomic.StoreInt64(&this.numQueued, int64(len(this.worklist)))
+	atomic.StoreInt64(&this.numRunning, int64(this.outstanding))
+}
+
 // Signals that no more batches are incoming, and then waits for batch
 // processing to complete.
 func (this *BatchProcessor) Finish() {
@@ -135,6 +157,7 @@ func (this *BatchProcessor) waitForBatches() {
 		select {
 		case batch := <-this.batchQueue:
 			this.enqueueBatch(batch)
+			this.publishStats()
 
 		case <-this.taskDone:
 			// A single task has completed.
@@ -147,8 +170,10 @@ func (this *BatchProcessor) waitForBatches() {
 				this.worklist = this.worklist[:len(this.worklist)-1]
 
 				this.enqueueItem(item)
+				this.publishStats()
 				continue
 			}
+			this.publishStats()
 
 			if !this.workRemaining() && stopped {
 				// If there's no work left to do, and the parent thread is
@@ -167,6 +192,7 @@ func (this *BatchProcessor) waitForBatches() {
 				// do notify the parent thread early, since it has no reason
 				// to wait on us.
 				this.worklist = nil
+				this.publishStats()
 				this.finishedSignal <- true
 
 				// If outstanding is 0, we can exit. Otherwise, there's a
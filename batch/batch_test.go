@@ -66,3 +66,37 @@ func TestTerminate(t *testing.T) {
 	// We should not block here. If we do, the test will be extremely slow.
 	bp.Terminate()
 }
+
+func TestStats(t *testing.T) {
+	release := make(chan bool)
+	bp := NewBatchProcessor(func(item interface{}) {
+		<-release
+	}, 3)
+
+	waitForStats := func(queued int, running int) {
+		deadline := time.Now().Add(time.Second * 5)
+		for {
+			q, r := bp.Stats()
+			if q == queued && r == running {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d queued and %d running, expected %d and %d", q, r, queued, running)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	bp.AddBatch(&MyBatch{})
+	waitForStats(7, 3)
+
+	release <- true
+	waitForStats(6, 3)
+
+	close(release)
+	bp.Finish()
+
+	if queued, running := bp.Stats(); queued != 0 || running != 0 {
+		t.Errorf("got %d queued and %d running after Finish()", queued, running)
+	}
+}
@@ -6,33 +6,72 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	batch "github.com/alliedmodders/blaster/batch"
+	expr "github.com/alliedmodders/blaster/expr"
 	valve "github.com/alliedmodders/blaster/valve"
 )
 
 var (
-	sOutputLock   sync.Mutex
-	sOutputBuffer io.Writer
-	sOutputFormat string
-	sNumServers   int64
+	sOutputLock sync.Mutex
+	sOutput     outputWriter
+	sWhere      *expr.Expr
+	sWhereWarn  sync.Once
+	sNumServers int64
+
+	// Number of servers received from the master (or read from -targets), and
+	// the number that were never queried because the crawl was interrupted.
+	sNumDiscovered int64
+	sNumSkipped    int64
+
+	// Number of servers queried so far, and how many of those failed.
+	sNumCompleted int64
+	sNumFailed    int64
 )
 
+// Details of a failed query. Phase, code, and retryable are only known for
+// errors from server queries.
+type ErrorDetails struct {
+	Error     string `json:"error"`
+	Phase     string `json:"phase,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Retryable bool   `json:"retryable"`
+}
+
 type ErrorObject struct {
-	Ip    string `json:"ip"`
-	Error string `json:"error"`
+	Ip string `json:"ip"`
+	ErrorDetails
+}
+
+func newErrorDetails(err error) *ErrorDetails {
+	details := &ErrorDetails{
+		Error: err.Error(),
+	}
+
+	var queryErr *valve.QueryError
+	if errors.As(err, &queryErr) {
+		details.Phase = string(queryErr.Phase)
+		details.Code = queryErr.Code
+		details.Retryable = queryErr.Retryable
+	}
+	return details
 }
 
 type ServerObject struct {
@@ -51,6 +90,11 @@ type ServerObject struct {
 	Visibility   string `json:"visibility"`
 	Vac          bool   `json:"vac"`
 
+	// Round-trip time of the info query in milliseconds. If the server
+	// required a challenge, its round trip is reported separately.
+	Ping          float64 `json:"ping"`
+	ChallengePing float64 `json:"challenge_ping,omitempty"`
+
 	// Only available from The Ship.
 	Ship *valve.TheShipInfo `json:"theship,omitempty"`
 
@@ -67,66 +111,166 @@ type ServerObject struct {
 	// Only available on Half-Life 1.
 	Mod *valve.ModInfo `json:"mod,omitempty"`
 
-	Rules map[string]string `json:"rules"`
+	// This is either a map of rules, or an ErrorDetails object if the query
+	// failed.
+	Rules interface{} `json:"rules"`
+
+	// Only present with -players. This is either a list of players, or an
+	// ErrorDetails object if the query failed.
+	PlayerList interface{} `json:"player_list,omitempty"`
 }
 
-func addJson(hostAndPort string, obj interface{}) {
+// Convert a duration to fractional milliseconds.
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
+
+// Evaluate -where against a result, using the same field names as the JSON
+// output. A result the expression can't be evaluated for does not match.
+func matchWhere(hostAndPort string, obj interface{}) bool {
 	buf, err := json.Marshal(obj)
 	if err != nil {
 		panic(err)
 	}
+	env := map[string]interface{}{}
+	if err := json.Unmarshal(buf, &env); err != nil {
+		panic(err)
+	}
 
-	sOutputLock.Lock()
-	defer sOutputLock.Unlock()
-
-	switch sOutputFormat {
-	case "lines":
-		if sNumServers != 0 {
-			sOutputBuffer.Write([]byte("\n"))
-		}
-
-		sOutputBuffer.Write(buf)
-
-		sNumServers++
-		return
+	// Evaluation can fail for some servers and not others, for example when
+	// a failed player query leaves an error object where a list is expected,
+	// so we only warn about the first one.
+	matched, err := sWhere.Match(env)
+	if err != nil {
+		sWhereWarn.Do(func() {
+			fmt.Fprintf(os.Stderr, "Could not evaluate -where for %s, leaving it out: %s\n", hostAndPort, err.Error())
+			fmt.Fprintf(os.Stderr, "Other servers that fail to evaluate will be left out without a warning.\n")
+		})
+		return false
 	}
+	return matched
+}
 
-	if sNumServers != 0 {
-		sOutputBuffer.Write([]byte(",\n"))
+func addResult(hostAndPort string, obj interface{}) {
+	if sWhere != nil && !matchWhere(hostAndPort, obj) {
+		return
 	}
-	sOutputBuffer.Write([]byte("\t"))
 
-	var indented bytes.Buffer
-	json.Indent(&indented, buf, "\t", "\t")
+	sOutputLock.Lock()
+	defer sOutputLock.Unlock()
 
-	switch sOutputFormat {
-	case "map":
-		sOutputBuffer.Write([]byte(fmt.Sprintf("\"%s\": ", hostAndPort)))
+	// This can only fail for I/O errors or a bad -template, neither of which
+	// will fix itself for the next server.
+	if err := sOutput.write(hostAndPort, obj); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write output: %s\n", err.Error())
+		os.Exit(1)
 	}
-
-	indented.WriteTo(sOutputBuffer)
 	sNumServers++
 }
 
 func addError(hostAndPort string, err error) {
-	addJson(hostAndPort, &ErrorObject{
-		Ip:    hostAndPort,
-		Error: err.Error(),
+	atomic.AddInt64(&sNumFailed, 1)
+	addResult(hostAndPort, &ErrorObject{
+		Ip:           hostAndPort,
+		ErrorDetails: *newErrorDetails(err),
 	})
 }
 
+// Read a master query checkpoint. If the file does not exist, nil is returned.
+func readCheckpoint(path string) (*valve.MasterCheckpoint, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := &valve.MasterCheckpoint{}
+	if err := json.Unmarshal(buf, checkpoint); err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// Write a master query checkpoint. The file is replaced atomically so a crash
+// never leaves a partial checkpoint behind.
+func writeCheckpoint(path string, checkpoint *valve.MasterCheckpoint) error {
+	buf, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	temp := path + ".tmp"
+	if err := ioutil.WriteFile(temp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "proxy" {
+		runProxy(os.Args[2:])
+		return
+	}
+
 	flag_game := flag.String("game", "", "Game (hl1, hl2)")
 	flag_appid := flag.Int("appid", 0, "Query a single AppID")
 	flag_appids := flag.String("appids", "", "Comma-delimited list of AppIDs")
 	flag_master := flag.String("master", valve.MasterServer, "Master server address")
+	flag_mastertimeout := flag.Duration("mastertimeout", time.Minute*5, "Timeout for each reply from the master (with -shard, this is how long a stalled query waits before it is split)")
 	flag_j := flag.Int("j", 20, "Number of concurrent requests (more will introduce more timeouts)")
+	flag_sockets := flag.Int("sockets", 0, "Number of shared UDP sockets to query servers over (0 opens a socket per server)")
 	flag_timeout := flag.Duration("timeout", time.Second*3, "Timeout for querying servers")
-	flag_format := flag.String("format", "list", "JSON format (list, map, or lines)")
+	flag_retries := flag.Int("retries", 0, "Number of times to retry each server query packet that times out")
+	flag_retrytimeout := flag.Duration("retrytimeout", 0, "Timeout for each attempt when retrying (default: -timeout)")
+	flag_backoff := flag.Duration("backoff", time.Millisecond*250, "Wait before the first retry, doubling after each further retry")
+	flag_format := flag.String("format", "list", "Output format (list, map, or lines for JSON; csv or tsv for tables)")
+	flag_columns := flag.String("columns", "", "Comma-delimited list of columns to output with -format csv or tsv (default: all)")
+	flag_rulesfile := flag.String("rulesfile", "", "With -format csv or tsv, write rules to this file with one row per rule, instead of a rules column")
+	flag_playersfile := flag.String("playersfile", "", "With -format csv or tsv, write players to this file with one row per player, instead of a player_list column (implies -players)")
+	flag_template := flag.String("template", "", "Write each server through this Go text/template instead of -format (@file reads the template from a file)")
+	flag_header := flag.String("header", "", "With -template, a template written before the results")
+	flag_footer := flag.String("footer", "", "With -template, a template written after the results, given .Servers and .Errors")
 	flag_outfile := flag.String("outfile", "", "Output to a file")
+	flag_resume := flag.String("resume", "", "Save master query progress to this file, and resume from it if it exists")
 	flag_norules := flag.Bool("norules", false, "Don't query server rules")
+	flag_players := flag.Bool("players", false, "Query the list of players on each server")
+	flag_filter := flag.String("filter", "", "Raw master server filter (for example, \\secure\\1\\linux\\1)")
+	flag_dedicated := flag.Bool("dedicated", false, "Only list dedicated servers")
+	flag_secure := flag.Bool("secure", false, "Only list VAC-secured servers")
+	flag_linux := flag.Bool("linux", false, "Only list servers running on Linux")
+	flag_notempty := flag.Bool("notempty", false, "Only list servers that are not empty")
+	flag_notfull := flag.Bool("notfull", false, "Only list servers that are not full")
+	flag_noplayers := flag.Bool("noplayers", false, "Only list servers that are empty")
+	flag_proxy := flag.Bool("proxy", false, "Only list spectator proxies")
+	flag_whitelisted := flag.Bool("whitelisted", false, "Only list whitelisted servers")
+	flag_collapse := flag.Bool("collapse", false, "Only list one server per IP address")
+	flag_map := flag.String("map", "", "Only list servers running this map")
+	flag_gamedir := flag.String("gamedir", "", "Only list servers running this mod directory")
+	flag_gametype := flag.String("gametype", "", "Only list servers with all of these comma-delimited sv_tags")
+	flag_gamedata := flag.String("gamedata", "", "Only list servers with all of these comma-delimited hidden tags")
+	flag_gamedataor := flag.String("gamedataor", "", "Only list servers with any of these comma-delimited hidden tags")
+	flag_namematch := flag.String("namematch", "", "Only list servers whose name matches this pattern (* is a wildcard)")
+	flag_versionmatch := flag.String("versionmatch", "", "Only list servers whose version matches this pattern (* is a wildcard)")
+	flag_region := flag.String("region", "all", "Comma-delimited list of regions to query separately (us-east, us-west, south-america, europe, asia, australia, middle-east, africa, all), or \"each\" for every region")
+	flag_shard := flag.String("shard", "", "Comma-delimited list of ways to split master queries that time out (empty, dedicated, secure, linux)")
+	flag_shardalways := flag.Bool("shardalways", false, "Always split master queries using -shard, not just when they time out")
+	flag_gameaddr := flag.String("gameaddr", "", "Only list servers on this IP address (port is optional)")
+	flag_minping := flag.Duration("minping", 0, "Only list servers whose ping is at least this long (for example, 20ms)")
+	flag_maxping := flag.Duration("maxping", 0, "Only list servers whose ping is at most this long (for example, 150ms)")
+	flag_sort := flag.String("sort", "", "Write servers in order of these comma-delimited keys (players, name, map, latency, address) once every server is queried")
+	flag_summary := flag.String("summary", "", "Write totals for each value of these comma-delimited fields (for example appid,map,os) instead of servers, or \"all\" for appid,map,os,type,vac,game_version")
+	flag_summaryfile := flag.String("summaryfile", "", "Write the -summary to this file, and servers to the usual output")
+	flag_where := flag.String("where", "", "Only output servers matching this expression, for example 'players - bots >= 4 && rules[\"sm_version\"] =~ \"^1\\.11\"'")
+	flag_quiet := flag.Bool("quiet", false, "Don't report progress on stderr")
+	flag_progress := flag.String("progress", "text", "Progress report format (text, or json for one JSON object per line)")
+	flag_progressinterval := flag.Duration("progressinterval", 0, "How often to report progress (default 1s on a terminal, otherwise 10s)")
+	flag_targets := flag.String("targets", "", "Query the servers in this file (\"-\" for stdin) instead of the master; either one host:port per line, or earlier blaster output")
+	flag_onlyerrors := flag.Bool("onlyerrors", false, "With -targets, only query servers that failed in the earlier blaster output (which must be JSON)")
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: -game or -appids\n")
+		fmt.Fprintf(os.Stderr, "Usage: -game, -appids, -filter, or -targets\n")
+		fmt.Fprintf(os.Stderr, "       blaster proxy -upstream <address> -listen <address>\n")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
@@ -134,13 +278,68 @@ func main() {
 	appids := []valve.AppId{}
 
 	switch *flag_format {
-	case "list", "map", "lines":
-		sOutputFormat = *flag_format
+	case "list", "map", "lines", "csv", "tsv":
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown format type.\n")
 		os.Exit(1)
 	}
 
+	if *flag_where != "" {
+		where, err := expr.Parse(*flag_where)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -where: %s\n", err.Error())
+			os.Exit(1)
+		}
+		sWhere = where
+	}
+
+	switch *flag_progress {
+	case "text", "json":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown progress format.\n")
+		os.Exit(1)
+	}
+
+	formatSet := false
+	flag.Visit(func(f *flag.Flag) {
+		formatSet = formatSet || f.Name == "format"
+	})
+	if *flag_template != "" && formatSet {
+		fmt.Fprintf(os.Stderr, "-template cannot be used with -format.\n")
+		os.Exit(1)
+	}
+	if *flag_template == "" && (*flag_header != "" || *flag_footer != "") {
+		fmt.Fprintf(os.Stderr, "-header and -footer require -template.\n")
+		os.Exit(1)
+	}
+
+	if *flag_summaryfile != "" && *flag_summary == "" {
+		fmt.Fprintf(os.Stderr, "-summaryfile requires -summary.\n")
+		os.Exit(1)
+	}
+	if *flag_summary != "" && *flag_summaryfile == "" && *flag_template != "" {
+		fmt.Fprintf(os.Stderr, "-template requires -summaryfile when used with -summary.\n")
+		os.Exit(1)
+	}
+	if *flag_summary != "" && *flag_summaryfile == "" && *flag_sort != "" {
+		fmt.Fprintf(os.Stderr, "-sort requires -summaryfile when used with -summary.\n")
+		os.Exit(1)
+	}
+
+	tables := *flag_format == "csv" || *flag_format == "tsv"
+	if !tables && (*flag_columns != "" || *flag_rulesfile != "" || *flag_playersfile != "") {
+		fmt.Fprintf(os.Stderr, "-columns, -rulesfile, and -playersfile require -format csv or tsv.\n")
+		os.Exit(1)
+	}
+	if *flag_rulesfile != "" && *flag_norules {
+		fmt.Fprintf(os.Stderr, "-rulesfile cannot be used with -norules.\n")
+		os.Exit(1)
+	}
+	if *flag_playersfile != "" {
+		*flag_players = true
+	}
+
+	var outputBuffer io.Writer = os.Stdout
 	if *flag_outfile != "" {
 		file, err := os.Create(*flag_outfile)
 		if err != nil {
@@ -149,9 +348,109 @@ func main() {
 		}
 		defer file.Close()
 
-		sOutputBuffer = file
-	} else {
-		sOutputBuffer = os.Stdout
+		outputBuffer = file
+	}
+
+	switch {
+	case *flag_template != "":
+		record, err := parseTemplate("template", *flag_template)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -template: %s\n", err.Error())
+			os.Exit(1)
+		}
+		writer := newTemplateWriter(outputBuffer, record)
+
+		if *flag_header != "" {
+			header, err := parseTemplate("header", *flag_header)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid -header: %s\n", err.Error())
+				os.Exit(1)
+			}
+			writer.setHeader(header)
+		}
+		if *flag_footer != "" {
+			footer, err := parseTemplate("footer", *flag_footer)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid -footer: %s\n", err.Error())
+				os.Exit(1)
+			}
+			writer.setFooter(footer)
+		}
+		sOutput = writer
+	case tables:
+		delimiter := ','
+		if *flag_format == "tsv" {
+			delimiter = '\t'
+		}
+
+		// Rules and players written to their own files are left out of the
+		// main table, unless asked for.
+		omit := []string{}
+		if *flag_rulesfile != "" {
+			omit = append(omit, "rules")
+		}
+		if *flag_playersfile != "" {
+			omit = append(omit, "player_list")
+		}
+		columns, err := parseColumns(*flag_columns, omit...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -columns: %s\n", err.Error())
+			os.Exit(1)
+		}
+		table := newTableWriter(outputBuffer, delimiter, columns)
+
+		if *flag_rulesfile != "" {
+			file, err := os.Create(*flag_rulesfile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not open %s for writing: %s\n", *flag_rulesfile, err.Error())
+				os.Exit(1)
+			}
+			defer file.Close()
+			table.setRulesOutput(file)
+		}
+		if *flag_playersfile != "" {
+			file, err := os.Create(*flag_playersfile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not open %s for writing: %s\n", *flag_playersfile, err.Error())
+				os.Exit(1)
+			}
+			defer file.Close()
+			table.setPlayersOutput(file)
+		}
+		sOutput = table
+	default:
+		sOutput = newJsonWriter(outputBuffer, *flag_format)
+	}
+
+	if *flag_sort != "" {
+		keys, err := parseSortKeys(*flag_sort)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -sort: %s\n", err.Error())
+			os.Exit(1)
+		}
+		sOutput = newSortingWriter(sOutput, keys)
+	}
+
+	if *flag_summary != "" {
+		dimensions, err := parseSummaryDimensions(*flag_summary)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -summary: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		// The summary is in the same format as the servers would have been,
+		// or JSON for -template.
+		if *flag_summaryfile != "" {
+			file, err := os.Create(*flag_summaryfile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not open %s for writing: %s\n", *flag_summaryfile, err.Error())
+				os.Exit(1)
+			}
+			defer file.Close()
+			sOutput = teeWriter{sOutput, newSummaryWriter(file, *flag_format, dimensions)}
+		} else {
+			sOutput = newSummaryWriter(outputBuffer, *flag_format, dimensions)
+		}
 	}
 
 	if *flag_game != "" {
@@ -181,39 +480,251 @@ func main() {
 		appids = append(appids, valve.AppId(*flag_appid))
 	}
 
-	if len(appids) == 0 {
-		fmt.Fprintf(os.Stderr, "At least one AppID or game must be specified.\n")
+	// Build the list of conditions that apply to every AppID.
+	filters := valve.FilterList{}
+	if *flag_dedicated {
+		filters = append(filters, valve.FilterDedicated())
+	}
+	if *flag_secure {
+		filters = append(filters, valve.FilterSecure())
+	}
+	if *flag_linux {
+		filters = append(filters, valve.FilterLinux())
+	}
+	if *flag_notempty {
+		filters = append(filters, valve.FilterNotEmpty())
+	}
+	if *flag_notfull {
+		filters = append(filters, valve.FilterNotFull())
+	}
+	if *flag_noplayers {
+		filters = append(filters, valve.FilterNoPlayers())
+	}
+	if *flag_proxy {
+		filters = append(filters, valve.FilterProxy())
+	}
+	if *flag_whitelisted {
+		filters = append(filters, valve.FilterWhitelisted())
+	}
+	if *flag_collapse {
+		filters = append(filters, valve.FilterCollapseAddrHash())
+	}
+	if *flag_map != "" {
+		filters = append(filters, valve.FilterMap(*flag_map))
+	}
+	if *flag_gamedir != "" {
+		filters = append(filters, valve.FilterGameDir(*flag_gamedir))
+	}
+	if *flag_gametype != "" {
+		filters = append(filters, valve.FilterGameType(strings.Split(*flag_gametype, ",")...))
+	}
+	if *flag_gamedata != "" {
+		filters = append(filters, valve.FilterGameData(strings.Split(*flag_gamedata, ",")...))
+	}
+	if *flag_gamedataor != "" {
+		filters = append(filters, valve.FilterGameDataOr(strings.Split(*flag_gamedataor, ",")...))
+	}
+	if *flag_namematch != "" {
+		filters = append(filters, valve.FilterNameMatch(*flag_namematch))
+	}
+	if *flag_versionmatch != "" {
+		filters = append(filters, valve.FilterVersionMatch(*flag_versionmatch))
+	}
+	if *flag_gameaddr != "" {
+		filters = append(filters, valve.FilterGameAddr(*flag_gameaddr))
+	}
+	if *flag_filter != "" {
+		if !strings.HasPrefix(*flag_filter, "\\") {
+			fmt.Fprintf(os.Stderr, "Filters must be in the form \\key\\value.\n")
+			os.Exit(1)
+		}
+		filters = append(filters, valve.RawFilter(*flag_filter))
+	}
+
+	if *flag_onlyerrors && *flag_targets == "" {
+		fmt.Fprintf(os.Stderr, "-onlyerrors requires -targets.\n")
+		os.Exit(1)
+	}
+	if *flag_targets != "" {
+		if len(appids) != 0 || len(filters) != 0 {
+			fmt.Fprintf(os.Stderr, "AppIDs and master server filters cannot be used with -targets.\n")
+			os.Exit(1)
+		}
+		if *flag_resume != "" {
+			fmt.Fprintf(os.Stderr, "-resume cannot be used with -targets.\n")
+			os.Exit(1)
+		}
+	} else if len(appids) == 0 && *flag_filter == "" {
+		fmt.Fprintf(os.Stderr, "At least one AppID, game, -filter, or -targets must be specified.\n")
 		os.Exit(1)
 	}
 
+	regions := []valve.Region{}
+	if *flag_region == "each" {
+		regions = append(regions, valve.Regions...)
+	} else {
+		for _, part := range strings.Split(*flag_region, ",") {
+			region, err := valve.ParseRegion(part)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "\"%s\" is not a valid region\n", part)
+				os.Exit(1)
+			}
+			regions = append(regions, region)
+		}
+	}
+
+	partitions := []valve.Partition{}
+	if *flag_shard != "" {
+		for _, part := range strings.Split(*flag_shard, ",") {
+			partition, err := valve.ParsePartition(part)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "\"%s\" is not a valid shard type\n", part)
+				os.Exit(1)
+			}
+			partitions = append(partitions, partition)
+		}
+	}
+
+	// Read the target list up front, so a bad file fails before any output.
+	var targets valve.ServerList
+	if *flag_targets != "" {
+		var err error
+		if targets, err = readTargetFile(*flag_targets, *flag_onlyerrors); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read targets from %s: %s\n", *flag_targets, err.Error())
+			os.Exit(1)
+		}
+	}
+
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	// Create a connection to the master server.
-	master, err := valve.NewMasterServerQuerier(*flag_master)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not query master: %s", err.Error())
+	// The first Ctrl-C stops the master query and any servers that have not
+	// been queried yet, but waits for queries in progress. The second Ctrl-C
+	// cancels those too. Either way the output is still a valid document. A
+	// third Ctrl-C kills the process.
+	//
+	// With -resume, the checkpoint is already past every server received from
+	// the master, so the first Ctrl-C only stops the master query, and the
+	// servers already received are still queried. The rest is as above, one
+	// Ctrl-C later.
+	crawlCtx, stopCrawl := context.WithCancel(context.Background())
+	masterCtx, stopMaster := context.WithCancel(crawlCtx)
+	queryCtx, stopQueries := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go (func() {
+		<-signals
+		if *flag_resume != "" {
+			fmt.Fprintf(os.Stderr, "Interrupted, querying the servers already received...\n")
+			stopMaster()
+			<-signals
+		}
+		fmt.Fprintf(os.Stderr, "Interrupted, waiting for queries in progress...\n")
+		stopCrawl()
+		<-signals
+		stopQueries()
+		signal.Stop(signals)
+	})()
+
+	retryPolicy := valve.RetryPolicy{
+		Attempts: *flag_retries + 1,
+		Timeout:  *flag_retrytimeout,
+		Backoff:  *flag_backoff,
 	}
-	defer master.Close()
 
-	// Set up the filter list.
-	master.FilterAppIds(appids)
+	var progress *progressReporter
+	if !*flag_quiet {
+		progress = newProgressReporter(os.Stderr, *flag_progress == "json", *flag_progressinterval)
+	}
+
+	// Create a connection to the master server, unless we were given targets.
+	var master *valve.MasterServerQuerier
+	var err error
+	if targets == nil {
+		master, err = valve.NewMasterServerQuerier(*flag_master)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not query master: %s", err.Error())
+		}
+		defer master.Close()
+
+		master.SetTimeout(*flag_mastertimeout)
+
+		// Set up the filter list.
+		master.FilterAppIds(appids)
+		master.AddCommonFilter(filters...)
+		master.SetRegions(regions...)
+		master.SetPartitions(*flag_shardalways, partitions...)
+		if progress != nil {
+			master.SetPageCallback(progress.onPage)
+		}
+
+		// Resume from an earlier checkpoint, if there is one, and record
+		// progress as we go.
+		if *flag_resume != "" {
+			checkpoint, err := readCheckpoint(*flag_resume)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not read checkpoint %s: %s\n", *flag_resume, err.Error())
+				os.Exit(1)
+			}
+			if checkpoint != nil {
+				master.Resume(checkpoint)
+			}
+			master.SetCheckpointCallback(func(checkpoint *valve.MasterCheckpoint) error {
+				return writeCheckpoint(*flag_resume, checkpoint)
+			})
+		}
+	}
+
+	// If requested, query every server over a small set of shared sockets.
+	var shared *valve.SharedUdpSocket
+	if *flag_sockets > 0 {
+		shared, err = valve.NewSharedUdpSocket(*flag_sockets)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not open shared sockets: %s\n", err.Error())
+			os.Exit(1)
+		}
+		defer shared.Close()
+	}
 
 	// Initialize our batch processor, which will receive servers and query them
 	// concurrently.
 	bp := batch.NewBatchProcessor(func(item interface{}) {
 		addr := item.(*net.TCPAddr)
-		query, err := valve.NewServerQuerier(addr.String(), *flag_timeout)
+
+		// Once the crawl is stopped, we drain the remaining work without
+		// querying it. This is like Terminate(), except that we can still
+		// wait for tasks already in progress.
+		if crawlCtx.Err() != nil {
+			atomic.AddInt64(&sNumSkipped, 1)
+			return
+		}
+		defer atomic.AddInt64(&sNumCompleted, 1)
+
+		var query *valve.ServerQuerier
+		var err error
+		if shared != nil {
+			var socket valve.QuerySocket
+			if socket, err = shared.Dial(addr.String(), *flag_timeout); err == nil {
+				query = valve.NewServerQuerierFromSocket(socket, *flag_timeout)
+			}
+		} else {
+			query, err = valve.NewServerQuerier(addr.String(), *flag_timeout)
+		}
 		if err != nil {
 			addError(addr.String(), err)
 			return
 		}
 		defer query.Close()
+		query.SetRetryPolicy(retryPolicy)
 
-		info, err := query.QueryInfo()
+		info, err := query.QueryInfoContext(queryCtx)
 		if err != nil {
 			addError(addr.String(), err)
 			return
 		}
+		if (*flag_minping > 0 && info.Ping < *flag_minping) ||
+			(*flag_maxping > 0 && info.Ping > *flag_maxping) {
+			return
+		}
 
 		out := &ServerObject{
 			Address:    addr.String(),
@@ -229,6 +740,9 @@ func main() {
 			Os:         info.OS.String(),
 			Ship:       info.TheShip,
 			Mod:        info.Mod,
+
+			Ping:          milliseconds(info.Ping),
+			ChallengePing: milliseconds(info.ChallengePing),
 		}
 		if info.Vac == 1 {
 			out.Vac = true
@@ -257,48 +771,96 @@ func main() {
 		// We can't query rules for CSGO servers anymore because Valve.
 		csgo := (info.Ext != nil && info.Ext.AppId == valve.App_CSGO)
 		if !csgo && !*flag_norules {
-			rules, err := query.QueryRules()
+			rules, err := query.QueryRulesContext(queryCtx)
 			if err != nil {
-				out.Rules = map[string]string{
-					"error": err.Error(),
-				}
+				out.Rules = newErrorDetails(err)
 			} else {
 				out.Rules = rules
 			}
 		}
 
-		addJson(addr.String(), out)
+		if *flag_players {
+			players, err := query.QueryPlayersContext(queryCtx)
+			if err != nil {
+				out.PlayerList = newErrorDetails(err)
+			} else {
+				out.PlayerList = players
+			}
+		}
+
+		addResult(addr.String(), out)
 	}, *flag_j)
 	defer bp.Terminate()
 
-	switch sOutputFormat {
-	case "list":
-		sOutputBuffer.Write([]byte("[\n"))
-	case "map":
-		sOutputBuffer.Write([]byte("{\n"))
+	if progress != nil {
+		progress.start(bp)
 	}
 
-	// Query the master.
-	err = master.Query(func(servers valve.ServerList) error {
-		bp.AddBatch(servers)
-		return nil
-	})
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not query the master: %s\n", err.Error())
+	if err := sOutput.begin(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write output: %s\n", err.Error())
 		os.Exit(1)
 	}
 
+	if targets != nil {
+		atomic.AddInt64(&sNumDiscovered, int64(len(targets)))
+		bp.AddBatch(targets)
+	} else {
+		// Query the master.
+		err = master.QueryContext(masterCtx, func(servers valve.ServerList) error {
+			atomic.AddInt64(&sNumDiscovered, int64(len(servers)))
+			bp.AddBatch(servers)
+			return nil
+		})
+	}
+	if err != nil {
+		if masterCtx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "Could not query the master: %s\n", err.Error())
+		}
+
+		// No more servers are coming, but the ones the master already sent
+		// are still queried.
+	} else if *flag_resume != "" {
+		// The master query is complete, so the checkpoint is no longer needed.
+		os.Remove(*flag_resume)
+	}
+
+	if progress != nil {
+		progress.setListComplete()
+	}
+
 	// Wait for batch processing to complete.
 	bp.Finish()
+	if progress != nil {
+		progress.stop()
+	}
 
-	if sNumServers != 0 {
-		sOutputBuffer.Write([]byte("\n"))
+	if err := sOutput.end(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write output: %s\n", err.Error())
+		os.Exit(1)
 	}
 
-	switch sOutputFormat {
-	case "list":
-		sOutputBuffer.Write([]byte("]\n"))
-	case "map":
-		sOutputBuffer.Write([]byte("}\n"))
+	if masterCtx.Err() != nil {
+		if targets != nil {
+			fmt.Fprintf(os.Stderr, "Stopped early: %d targets, %d written, %d not queried.\n",
+				sNumDiscovered, sNumServers, sNumSkipped)
+			os.Exit(1)
+		}
+
+		fmt.Fprintf(os.Stderr, "Stopped early: %d servers received from the master, %d written, %d not queried.\n",
+			sNumDiscovered, sNumServers, sNumSkipped)
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "The master server list was complete.\n")
+		} else {
+			fmt.Fprintf(os.Stderr, "The master server list is incomplete.\n")
+			if *flag_resume != "" && sNumSkipped > 0 {
+				fmt.Fprintf(os.Stderr, "Servers that were not queried will not be queried by -resume either.\n")
+			}
+		}
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "The master server list is incomplete: %d servers received from the master, %d written.\n",
+			sNumDiscovered, sNumServers)
+		os.Exit(1)
 	}
 }
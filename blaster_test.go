@@ -0,0 +1,203 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	expr "github.com/alliedmodders/blaster/expr"
+	valve "github.com/alliedmodders/blaster/valve"
+	valvetest "github.com/alliedmodders/blaster/valve/valvetest"
+)
+
+// With BLASTER_TEST_MAIN set, the test binary runs as blaster itself, so tests
+// can run it in a subprocess and interrupt it.
+func TestMain(m *testing.M) {
+	if os.Getenv("BLASTER_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestUsageErrors(t *testing.T) {
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"-appids", "440", "-onlyerrors"}, "-onlyerrors requires -targets."},
+		{[]string{"-appids", "440", "-summary", "map", "-sort", "players"}, "-sort requires -summaryfile when used with -summary."},
+		{[]string{"-appids", "440", "-header", "x"}, "-header and -footer require -template."},
+	}
+
+	for _, test := range cases {
+		cmd := exec.Command(os.Args[0], test.args...)
+		cmd.Env = append(os.Environ(), "BLASTER_TEST_MAIN=1")
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err == nil {
+			t.Errorf("%v: expected blaster to fail", test.args)
+		}
+		if !strings.Contains(stderr.String(), test.expected) {
+			t.Errorf("%v: got %q, expected %q", test.args, stderr.String(), test.expected)
+		}
+	}
+}
+
+// Start a FakeMaster listing |count| slow FakeServers.
+func startCrawlServers(t *testing.T, count int, pageSize int, latency time.Duration) *valvetest.FakeMaster {
+	entries := []*valvetest.MasterEntry{}
+	for i := 0; i < count; i++ {
+		server := valvetest.NewFakeServer(&valve.ServerInfo{
+			InfoVersion: valve.S2A_INFO_SOURCE,
+			Name:        fmt.Sprintf("Server %d", i),
+			MapName:     "ctf_2fort",
+		})
+		server.Latency = latency
+		if err := server.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(server.Close)
+		entries = append(entries, &valvetest.MasterEntry{Addr: server.Addr(), Region: valve.Region_All})
+	}
+
+	master := valvetest.NewFakeMaster(entries)
+	master.PageSize = pageSize
+	if err := master.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(master.Close)
+	return master
+}
+
+// Run blaster against a master, sending Ctrl-C after each of the given delays.
+// Returns the results it wrote, which must be a valid JSON list, and stderr.
+func runInterrupted(t *testing.T, master *valvetest.FakeMaster, args []string, interrupts ...time.Duration) ([]map[string]interface{}, string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("cannot send Ctrl-C to a subprocess on Windows")
+	}
+
+	args = append([]string{"-master", master.Addr(), "-filter", "\\gameaddr\\127.0.0.1", "-norules", "-quiet"}, args...)
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "BLASTER_TEST_MAIN=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, delay := range interrupts {
+		time.Sleep(delay)
+		cmd.Process.Signal(os.Interrupt)
+	}
+
+	// Stopping early is reported with a failing exit code.
+	if err := cmd.Wait(); err == nil {
+		t.Errorf("expected blaster to fail after being interrupted")
+	}
+
+	results := []map[string]interface{}{}
+	if err := json.Unmarshal(stdout.Bytes(), &results); err != nil {
+		t.Fatalf("output is not a JSON list: %v\n%s\nstderr: %s", err, stdout.String(), stderr.String())
+	}
+	return results, stderr.String()
+}
+
+// Parse the "Stopped early" summary.
+func stoppedEarly(t *testing.T, stderr string) (received, written, skipped int) {
+	index := strings.Index(stderr, "Stopped early:")
+	if index < 0 {
+		t.Fatalf("expected a summary, got: %s", stderr)
+	}
+	_, err := fmt.Sscanf(stderr[index:], "Stopped early: %d servers received from the master, %d written, %d not queried.",
+		&received, &written, &skipped)
+	if err != nil {
+		t.Fatalf("could not parse the summary: %v\n%s", err, stderr)
+	}
+	return
+}
+
+func TestInterrupt(t *testing.T) {
+	// Every server is received at once, then queried two at a time.
+	master := startCrawlServers(t, 20, 100, time.Millisecond*200)
+	results, stderr := runInterrupted(t, master, []string{"-j", "2"}, time.Millisecond*500)
+
+	received, written, skipped := stoppedEarly(t, stderr)
+	if received != 20 || written != len(results) || written+skipped != received || skipped == 0 {
+		t.Errorf("got %d results; %s", len(results), stderr)
+	}
+	for _, result := range results {
+		if result["error"] != nil {
+			t.Errorf("queries in progress should finish, got %v", result)
+		}
+	}
+}
+
+func TestInterruptTwice(t *testing.T) {
+	// The second Ctrl-C cancels the queries in progress, which are reported
+	// as failures.
+	master := startCrawlServers(t, 20, 100, time.Second*2)
+	start := time.Now()
+	results, stderr := runInterrupted(t, master, []string{"-j", "2"}, time.Millisecond*500, time.Millisecond*100)
+	if elapsed := time.Since(start); elapsed > time.Millisecond*1500 {
+		t.Errorf("took %v to stop", elapsed)
+	}
+
+	received, written, skipped := stoppedEarly(t, stderr)
+	if received != 20 || written != 2 || skipped != 18 || len(results) != 2 {
+		t.Errorf("got %d results; %s", len(results), stderr)
+	}
+	for _, result := range results {
+		if result["code"] != "canceled" {
+			t.Errorf("expected a cancelled query, got %v", result)
+		}
+	}
+}
+
+func TestInterruptWithResume(t *testing.T) {
+	// The master sends a page of 5 servers, then is rate limited for a few
+	// seconds. Ctrl-C stops the master, but the first page is still queried.
+	master := startCrawlServers(t, 20, 5, time.Millisecond*100)
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+	results, stderr := runInterrupted(t, master, []string{"-j", "2", "-resume", checkpoint}, time.Millisecond*500)
+
+	received, written, skipped := stoppedEarly(t, stderr)
+	if received != 5 || written != 5 || skipped != 0 || len(results) != 5 {
+		t.Errorf("got %d results; %s", len(results), stderr)
+	}
+	if _, err := os.Stat(checkpoint); err != nil {
+		t.Errorf("expected a checkpoint: %v", err)
+	}
+}
+
+func TestMatchWhere(t *testing.T) {
+	where, err := expr.Parse(`player_list[0].name == "Scout"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sWhere = where
+	defer (func() { sWhere = nil })()
+
+	if !matchWhere("10.0.0.1:27015", testServer()) {
+		t.Errorf("expected the server to match")
+	}
+
+	// Evaluating against an error object fails, which is not a match.
+	failed := testServer()
+	failed.PlayerList = &testError().ErrorDetails
+	if matchWhere("10.0.0.1:27015", failed) {
+		t.Errorf("expected a server that fails to evaluate not to match")
+	}
+}
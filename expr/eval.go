@@ -0,0 +1,348 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrNotBoolean = errors.New("expression did not evaluate to true or false")
+
+// Evaluate the expression. Identifiers that are not in the environment are
+// null. Arithmetic on null gives null, and comparisons involving null (other
+// than == and !=) are false, so missing fields simply fail to match.
+func (this *Expr) Eval(env map[string]interface{}) (interface{}, error) {
+	return this.root.eval(env)
+}
+
+// Evaluate the expression as a condition. Null counts as false.
+func (this *Expr) Match(env map[string]interface{}) (bool, error) {
+	value, err := this.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	return truth(value)
+}
+
+func truth(value interface{}) (bool, error) {
+	switch value := value.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return value, nil
+	}
+	return false, ErrNotBoolean
+}
+
+// Describe a value's type for error messages.
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+type node interface {
+	eval(env map[string]interface{}) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (this *literalNode) eval(env map[string]interface{}) (interface{}, error) {
+	return this.value, nil
+}
+
+type identNode struct {
+	name string
+}
+
+func (this *identNode) eval(env map[string]interface{}) (interface{}, error) {
+	return env[this.name], nil
+}
+
+type indexNode struct {
+	value node
+	index node
+}
+
+func (this *indexNode) eval(env map[string]interface{}) (interface{}, error) {
+	value, err := this.value.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	index, err := this.index.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot index an object with a %s", typeName(index))
+		}
+		return value[key], nil
+	case []interface{}:
+		n, ok := index.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot index a list with a %s", typeName(index))
+		}
+		if n < 0 || int(n) >= len(value) || n != math.Trunc(n) {
+			return nil, nil
+		}
+		return value[int(n)], nil
+	}
+	return nil, fmt.Errorf("cannot index a %s", typeName(value))
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (this *unaryNode) eval(env map[string]interface{}) (interface{}, error) {
+	value, err := this.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch this.op {
+	case "!":
+		b, err := truth(value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot negate a %s", typeName(value))
+		}
+		return !b, nil
+	case "-":
+		switch value := value.(type) {
+		case nil:
+			return nil, nil
+		case float64:
+			return -value, nil
+		}
+		return nil, fmt.Errorf("cannot negate a %s", typeName(value))
+	}
+	panic("unknown unary operator " + this.op)
+}
+
+type binaryNode struct {
+	op    string
+	left  node
+	right node
+}
+
+func (this *binaryNode) eval(env map[string]interface{}) (interface{}, error) {
+	left, err := this.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || short-circuit.
+	switch this.op {
+	case "&&", "||":
+		l, err := truth(left)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs true or false, got a %s", this.op, typeName(left))
+		}
+		if (this.op == "&&" && !l) || (this.op == "||" && l) {
+			return l, nil
+		}
+		right, err := this.right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		r, err := truth(right)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs true or false, got a %s", this.op, typeName(right))
+		}
+		return r, nil
+	}
+
+	right, err := this.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch this.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		return compare(this.op, left, right)
+	}
+	return arithmetic(this.op, left, right)
+}
+
+func equal(left interface{}, right interface{}) bool {
+	return reflect.DeepEqual(left, right)
+}
+
+func compare(op string, left interface{}, right interface{}) (interface{}, error) {
+	if left == nil || right == nil {
+		return false, nil
+	}
+
+	var cmp int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare a number with a %s", typeName(right))
+		}
+		switch {
+		case l < r:
+			cmp = -1
+		case l > r:
+			cmp = 1
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare a string with a %s", typeName(right))
+		}
+		cmp = strings.Compare(l, r)
+	default:
+		return nil, fmt.Errorf("cannot compare a %s", typeName(left))
+	}
+
+	switch op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	}
+	return cmp >= 0, nil
+}
+
+func arithmetic(op string, left interface{}, right interface{}) (interface{}, error) {
+	if left == nil || right == nil {
+		return nil, nil
+	}
+
+	// + also joins strings.
+	if l, ok := left.(string); ok && op == "+" {
+		if r, ok := right.(string); ok {
+			return l + r, nil
+		}
+	}
+
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("cannot use %s on a %s and a %s", op, typeName(left), typeName(right))
+	}
+
+	switch op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, nil
+		}
+		return l / r, nil
+	case "%":
+		if r == 0 {
+			return nil, nil
+		}
+		return math.Mod(l, r), nil
+	}
+	panic("unknown binary operator " + op)
+}
+
+type matchNode struct {
+	negate  bool
+	value   node
+	pattern node
+	re      *regexp.Regexp // Set if the pattern is a constant.
+}
+
+func (this *matchNode) eval(env map[string]interface{}) (interface{}, error) {
+	value, err := this.value.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// Patterns that are not constants are compiled each time, since they may
+	// differ for every server.
+	re := this.re
+	if re == nil {
+		pattern, err := this.pattern.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		str, ok := pattern.(string)
+		if !ok {
+			return nil, fmt.Errorf("=~ needs a string pattern, got a %s", typeName(pattern))
+		}
+		if re, err = regexp.Compile(str); err != nil {
+			return nil, err
+		}
+	}
+
+	var matched bool
+	switch value := value.(type) {
+	case nil:
+		return false, nil
+	case string:
+		matched = re.MatchString(value)
+	case float64:
+		matched = re.MatchString(strconv.FormatFloat(value, 'f', -1, 64))
+	default:
+		return nil, fmt.Errorf("cannot match a %s", typeName(value))
+	}
+	return matched != this.negate, nil
+}
+
+type callNode struct {
+	name string
+	fn   func(args []interface{}) (interface{}, error)
+	args []node
+}
+
+func (this *callNode) eval(env map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(this.args))
+	for i, arg := range this.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+
+	value, err := this.fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s(): %s", this.name, err.Error())
+	}
+	return value, nil
+}
@@ -0,0 +1,168 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package expr
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// A server as it appears in blaster's JSON output.
+const kServer = `{
+	"ip": "192.168.1.10:27015",
+	"name": "Dust2 Only",
+	"map": "de_dust2",
+	"players": 10,
+	"max_players": 24,
+	"bots": 4,
+	"vac": true,
+	"ping": 38.5,
+	"game_version": "1.38.2.1",
+	"mod": null,
+	"rules": {"sm_version": "1.11.0.6911", "mp_timelimit": "30"},
+	"player_list": [{"name": "bob", "score": 3}]
+}`
+
+func serverEnv(t *testing.T) map[string]interface{} {
+	env := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(kServer), &env); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		expr     string
+		expected bool
+	}{
+		{`players - bots >= 4 && rules["sm_version"] =~ "^1\.11"`, true},
+		{`players - bots > 6`, false},
+		{`players / max_players > 0.4`, true},
+		{`players % 3 == 1`, true},
+		{`-bots < 0`, true},
+		{`map == "de_dust2" || map == "de_inferno"`, true},
+		{`map != 'de_dust2'`, false},
+		{`!vac`, false},
+		{`vac && ping < 50`, true},
+		{`(players + 2) * 2 == 24`, true},
+		{`players + 2 * 2 == 14`, true},
+		{`rules.mp_timelimit == "30"`, true},
+		{`number(rules.mp_timelimit) >= 30`, true},
+		{`number(name) == null`, true},
+		{`name =~ "(?i)dust"`, true},
+		{`name !~ "dust"`, true},
+		{`ping =~ "^38"`, true},
+		{`map =~ lower("^DE_") && name !~ upper(map)`, true},
+		{`player_list[0].name == "bob"`, true},
+		{`len(player_list) == 1 && len(rules) == 2`, true},
+		{`contains(lower(name), "dust2")`, true},
+		{`hasprefix(ip, "192.168.") && hassuffix(ip, ":27015")`, true},
+		{`vercmp(game_version, "1.38.10") < 0`, true},
+		{`vercmp(game_version, "1.38.2") > 0`, true},
+		{`vercmp(game_version, "1.38.2.1.0") == 0`, true},
+		{`"a" < "b" && "de_" + "dust2" == map`, true},
+
+		// Missing values are null, and never match comparisons.
+		{`missing == null`, true},
+		{`missing > 1 || missing < 1`, false},
+		{`missing + 1 == null`, true},
+		{`mod.url == null`, true},
+		{`rules["sv_tags"] =~ "alltalk"`, false},
+		{`player_list[5].name == null`, true},
+		{`missing`, false},
+		{`!missing`, true},
+		{`players / 0 == null`, true},
+
+		// && and || short-circuit, so the type error on the right is never
+		// evaluated.
+		{`false && name - 1`, false},
+		{`true || name - 1`, true},
+	}
+
+	env := serverEnv(t)
+	for _, test := range cases {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		matched, err := e.Match(env)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if matched != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.expr, matched, test.expected)
+		}
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	cases := []struct {
+		expr string
+		pos  int
+	}{
+		{`players >=`, 10},
+		{`players > 1 )`, 12},
+		{`name == "unterminated`, 8},
+		{`name =~ "("`, 5},
+		{`name =~ 3`, 5},
+		{`nosuch(name)`, 0},
+		{`len(name, map)`, 0},
+		{`rules.`, 6},
+		{`players # 2`, 8},
+		{`1.2.3 > 0`, 0},
+		{``, 0},
+	}
+
+	for _, test := range cases {
+		_, err := Parse(test.expr)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%s: expected a syntax error, got %v", test.expr, err)
+			continue
+		}
+		if syntaxErr.Pos != test.pos {
+			t.Errorf("%s: got error at %d, expected %d (%v)", test.expr, syntaxErr.Pos, test.pos, err)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	cases := []string{
+		`name - 1`,
+		`name > 1`,
+		`players && true`,
+		`rules[0]`,
+		`players.count`,
+		`lower(players)`,
+		`len(players)`,
+		`name =~ lower("(")`,
+		`name =~ players`,
+	}
+
+	env := serverEnv(t)
+	for _, test := range cases {
+		e, err := Parse(test)
+		if err != nil {
+			t.Errorf("%s: %v", test, err)
+			continue
+		}
+		if _, err := e.Match(env); err == nil {
+			t.Errorf("%s: expected an error", test)
+		}
+	}
+
+	e, err := Parse(`players + 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Match(env); !errors.Is(err, ErrNotBoolean) {
+		t.Errorf("expected ErrNotBoolean, got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type function struct {
+	args int
+	call func(args []interface{}) (interface{}, error)
+}
+
+// Functions available to expressions. Functions given null return null,
+// like the operators.
+var kFunctions = map[string]function{
+	"len":       {1, fnLen},
+	"lower":     {1, stringFunction(strings.ToLower)},
+	"upper":     {1, stringFunction(strings.ToUpper)},
+	"contains":  {2, stringPredicate(strings.Contains)},
+	"hasprefix": {2, stringPredicate(strings.HasPrefix)},
+	"hassuffix": {2, stringPredicate(strings.HasSuffix)},
+	"number":    {1, fnNumber},
+	"vercmp":    {2, fnVercmp},
+}
+
+func stringArgs(args []interface{}) ([]string, bool, error) {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case nil:
+			return nil, false, nil
+		case string:
+			strs[i] = arg
+		default:
+			return nil, false, fmt.Errorf("expected a string, got a %s", typeName(arg))
+		}
+	}
+	return strs, true, nil
+}
+
+func stringFunction(fn func(string) string) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		strs, ok, err := stringArgs(args)
+		if !ok {
+			return nil, err
+		}
+		return fn(strs[0]), nil
+	}
+}
+
+func stringPredicate(fn func(string, string) bool) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		strs, ok, err := stringArgs(args)
+		if !ok {
+			return nil, err
+		}
+		return fn(strs[0], strs[1]), nil
+	}
+}
+
+// The length of a string, list, or object.
+func fnLen(args []interface{}) (interface{}, error) {
+	switch arg := args[0].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return float64(len(arg)), nil
+	case []interface{}:
+		return float64(len(arg)), nil
+	case map[string]interface{}:
+		return float64(len(arg)), nil
+	}
+	return nil, fmt.Errorf("cannot take the length of a %s", typeName(args[0]))
+}
+
+// Convert a string, such as a rule value, to a number. Strings that are not
+// numbers give null.
+func fnNumber(args []interface{}) (interface{}, error) {
+	switch arg := args[0].(type) {
+	case nil:
+		return nil, nil
+	case float64:
+		return arg, nil
+	case bool:
+		if arg {
+			return float64(1), nil
+		}
+		return float64(0), nil
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		if err != nil {
+			return nil, nil
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("cannot convert a %s to a number", typeName(args[0]))
+}
+
+// Compare two dotted version strings, such as "1.38.2.1", returning -1, 0, or
+// 1. Numeric parts are compared as numbers, and missing parts count as zero,
+// so "1.10" > "1.9" and "1.2" == "1.2.0".
+func fnVercmp(args []interface{}) (interface{}, error) {
+	strs, ok, err := stringArgs(args)
+	if !ok {
+		return nil, err
+	}
+	return float64(compareVersions(strs[0], strs[1])), nil
+}
+
+func compareVersions(a string, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+
+		xn, xerr := strconv.ParseUint(x, 10, 64)
+		yn, yerr := strconv.ParseUint(y, 10, 64)
+		if xerr == nil && yerr == nil {
+			switch {
+			case xn < yn:
+				return -1
+			case xn > yn:
+				return 1
+			}
+			continue
+		}
+		if cmp := strings.Compare(x, y); cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
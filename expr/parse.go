@@ -0,0 +1,369 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+
+// Package expr implements a small expression language for filtering JSON-like
+// values, for example:
+//
+//	players - bots >= 4 && rules["sm_version"] =~ "^1\.11"
+//
+// Identifiers look up keys in the environment, and values are those produced
+// by encoding/json: nil, bool, float64, string, []interface{}, and
+// map[string]interface{}.
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A syntax error in an expression.
+type SyntaxError struct {
+	Pos int // Byte offset into the expression.
+	Msg string
+}
+
+func (this *SyntaxError) Error() string {
+	return fmt.Sprintf("position %d: %s", this.Pos+1, this.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	pos  int
+	text string // Operator or identifier text, or the unquoted string.
+	num  float64
+}
+
+// Operators, longest first so that "<=" is not read as "<".
+var kOperators = []string{
+	"&&", "||", "==", "!=", "=~", "!~", "<=", ">=",
+	"<", ">", "+", "-", "*", "/", "%", "!", "(", ")", "[", "]", ".", ",",
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func tokenize(source string) ([]token, error) {
+	tokens := []token{}
+	pos := 0
+	for pos < len(source) {
+		c := source[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+		case isIdentStart(c):
+			start := pos
+			for pos < len(source) && (isIdentStart(source[pos]) || isDigit(source[pos])) {
+				pos++
+			}
+			tokens = append(tokens, token{kind: tokIdent, pos: start, text: source[start:pos]})
+		case isDigit(c):
+			start := pos
+			for pos < len(source) && (isDigit(source[pos]) || source[pos] == '.') {
+				pos++
+			}
+			num, err := strconv.ParseFloat(source[start:pos], 64)
+			if err != nil {
+				return nil, &SyntaxError{start, fmt.Sprintf("invalid number \"%s\"", source[start:pos])}
+			}
+			tokens = append(tokens, token{kind: tokNumber, pos: start, num: num})
+		case c == '"' || c == '\'':
+			str, end, err := readString(source, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokString, pos: pos, text: str})
+			pos = end
+		default:
+			op := ""
+			for _, candidate := range kOperators {
+				if strings.HasPrefix(source[pos:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, &SyntaxError{pos, fmt.Sprintf("unexpected character '%c'", c)}
+			}
+			tokens = append(tokens, token{kind: tokOp, pos: pos, text: op})
+			pos += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: pos}), nil
+}
+
+// Read a quoted string starting at pos. Only the quote character and
+// backslash can be escaped; any other backslash is kept as-is, so regular
+// expressions such as "^1\.11" can be written naturally.
+func readString(source string, pos int) (string, int, error) {
+	quote := source[pos]
+	var out strings.Builder
+	for i := pos + 1; i < len(source); i++ {
+		c := source[i]
+		switch {
+		case c == quote:
+			return out.String(), i + 1, nil
+		case c == '\\' && i+1 < len(source) && (source[i+1] == quote || source[i+1] == '\\'):
+			out.WriteByte(source[i+1])
+			i++
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return "", 0, &SyntaxError{pos, "unterminated string"}
+}
+
+// Operator precedence for binary operators; higher binds tighter.
+var kPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "=~": 3, "!~": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (this *parser) peek() token {
+	return this.tokens[this.pos]
+}
+
+func (this *parser) next() token {
+	tok := this.tokens[this.pos]
+	if tok.kind != tokEOF {
+		this.pos++
+	}
+	return tok
+}
+
+func (this *parser) isOp(op string) bool {
+	tok := this.peek()
+	return tok.kind == tokOp && tok.text == op
+}
+
+func (this *parser) expect(op string) error {
+	if !this.isOp(op) {
+		return this.unexpected(fmt.Sprintf("expected \"%s\"", op))
+	}
+	this.next()
+	return nil
+}
+
+func (this *parser) unexpected(msg string) error {
+	tok := this.peek()
+	if tok.kind == tokEOF {
+		return &SyntaxError{tok.pos, msg + " at end of expression"}
+	}
+	return &SyntaxError{tok.pos, msg}
+}
+
+// Parse a binary expression whose operators bind at least as tightly as
+// minPrecedence.
+func (this *parser) parseBinary(minPrecedence int) (node, error) {
+	left, err := this.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := this.peek()
+		precedence, ok := kPrecedence[tok.text]
+		if tok.kind != tokOp || !ok || precedence < minPrecedence {
+			return left, nil
+		}
+		this.next()
+
+		right, err := this.parseBinary(precedence + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if tok.text == "=~" || tok.text == "!~" {
+			left, err = newMatchNode(tok, left, right)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		left = &binaryNode{op: tok.text, left: left, right: right}
+	}
+}
+
+func (this *parser) parseUnary() (node, error) {
+	if this.isOp("!") || this.isOp("-") {
+		op := this.next().text
+		operand, err := this.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return this.parsePostfix()
+}
+
+func (this *parser) parsePostfix() (node, error) {
+	value, err := this.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch {
+		case this.isOp("."):
+			this.next()
+			tok := this.next()
+			if tok.kind != tokIdent {
+				return nil, &SyntaxError{tok.pos, "expected a field name after \".\""}
+			}
+			value = &indexNode{value: value, index: &literalNode{tok.text}}
+		case this.isOp("["):
+			this.next()
+			index, err := this.parseBinary(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := this.expect("]"); err != nil {
+				return nil, err
+			}
+			value = &indexNode{value: value, index: index}
+		default:
+			return value, nil
+		}
+	}
+}
+
+func (this *parser) parsePrimary() (node, error) {
+	tok := this.peek()
+	switch tok.kind {
+	case tokNumber:
+		this.next()
+		return &literalNode{tok.num}, nil
+	case tokString:
+		this.next()
+		return &literalNode{tok.text}, nil
+	case tokIdent:
+		this.next()
+		switch tok.text {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		}
+		if this.isOp("(") {
+			return this.parseCall(tok)
+		}
+		return &identNode{tok.text}, nil
+	case tokOp:
+		if tok.text == "(" {
+			this.next()
+			inner, err := this.parseBinary(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := this.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+	}
+	return nil, this.unexpected("expected a value")
+}
+
+func (this *parser) parseCall(name token) (node, error) {
+	fn, ok := kFunctions[name.text]
+	if !ok {
+		return nil, &SyntaxError{name.pos, fmt.Sprintf("unknown function \"%s\"", name.text)}
+	}
+
+	this.next()
+	args := []node{}
+	for !this.isOp(")") {
+		if len(args) > 0 {
+			if err := this.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := this.parseBinary(1)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	this.next()
+
+	if len(args) != fn.args {
+		return nil, &SyntaxError{name.pos, fmt.Sprintf("%s() takes %d arguments, got %d", name.text, fn.args, len(args))}
+	}
+	return &callNode{name: name.text, fn: fn.call, args: args}, nil
+}
+
+func newMatchNode(op token, left node, right node) (node, error) {
+	match := &matchNode{negate: op.text == "!~", value: left, pattern: right}
+
+	// Compile constant patterns up front, so mistakes are reported before
+	// any servers are queried.
+	if literal, ok := right.(*literalNode); ok {
+		pattern, ok := literal.value.(string)
+		if !ok {
+			return nil, &SyntaxError{op.pos, fmt.Sprintf("%s needs a string pattern", op.text)}
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, &SyntaxError{op.pos, err.Error()}
+		}
+		match.re = re
+	}
+	return match, nil
+}
+
+// A parsed expression.
+type Expr struct {
+	source string
+	root   node
+}
+
+// Parse an expression.
+func Parse(source string) (*Expr, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.unexpected("unexpected token")
+	}
+	return &Expr{source: source, root: root}, nil
+}
+
+func (this *Expr) String() string {
+	return this.source
+}
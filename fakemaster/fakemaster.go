@@ -0,0 +1,71 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alliedmodders/blaster/valve/fakemaster"
+)
+
+// Read the server list, querying each server if the list is refreshed.
+func loadServers(path string, refresh time.Duration, timeout time.Duration) ([]*fakemaster.Entry, error) {
+	if refresh <= 0 {
+		timeout = 0
+	}
+	return fakemaster.LoadServerList(path, timeout)
+}
+
+func main() {
+	flag_listen := flag.String("listen", ":27011", "Address to listen on")
+	flag_servers := flag.String("servers", "", "File listing server addresses, one per line, each optionally followed by a region")
+	flag_refresh := flag.Duration("refresh", 0, "Query the listed servers this often, so filters can be evaluated (0 to never query)")
+	flag_timeout := flag.Duration("timeout", time.Second*3, "Timeout for querying each server")
+	flag_pagesize := flag.Int("pagesize", 0, "Number of servers in each reply (default: the Steam master's page size)")
+	flag_ratelimit := flag.Int("ratelimit", 0, "Maximum requests per minute from each address (0 for no limit)")
+	flag_droprate := flag.Float64("droprate", 0, "Fraction of requests to ignore, to simulate packet loss")
+	flag.Parse()
+
+	if *flag_servers == "" {
+		fmt.Fprintf(os.Stderr, "Must specify a server list via -servers.\n")
+		os.Exit(1)
+	}
+
+	servers, err := loadServers(*flag_servers, *flag_refresh, *flag_timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read server list: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	master := fakemaster.NewMaster(servers)
+	master.PageSize = *flag_pagesize
+	master.RateLimit = *flag_ratelimit
+	master.DropRate = *flag_droprate
+	if err := master.Listen(*flag_listen); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not listen: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer master.Close()
+
+	fmt.Fprintf(os.Stderr, "Listing %d servers on %s.\n", len(servers), master.Addr())
+
+	if *flag_refresh <= 0 {
+		select {}
+	}
+
+	// Re-read the list on each refresh, so it can be edited while running.
+	for range time.Tick(*flag_refresh) {
+		servers, err := loadServers(*flag_servers, *flag_refresh, *flag_timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read server list: %s\n", err.Error())
+			continue
+		}
+		master.SetServers(servers)
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/alliedmodders/blaster
 
-go 1.16
+go 1.18
 
 require (
 	github.com/coopernurse/gorp v1.6.1
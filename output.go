@@ -0,0 +1,125 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// An outputWriter writes query results in one output format. Each result is
+// either a *ServerObject or an *ErrorObject. Calls are serialized by the
+// caller.
+type outputWriter interface {
+	// Called once before any results are written.
+	begin() error
+
+	write(hostAndPort string, obj interface{}) error
+
+	// Called once after every result has been written.
+	end() error
+}
+
+// Writes results to several outputs.
+type teeWriter []outputWriter
+
+func (this teeWriter) begin() error {
+	for _, writer := range this {
+		if err := writer.begin(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this teeWriter) write(hostAndPort string, obj interface{}) error {
+	for _, writer := range this {
+		if err := writer.write(hostAndPort, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this teeWriter) end() error {
+	for _, writer := range this {
+		if err := writer.end(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes results as JSON, in the "list", "map", or "lines" layout.
+type jsonWriter struct {
+	out    io.Writer
+	format string
+	count  int
+}
+
+func newJsonWriter(out io.Writer, format string) *jsonWriter {
+	return &jsonWriter{
+		out:    out,
+		format: format,
+	}
+}
+
+func (this *jsonWriter) begin() error {
+	var err error
+	switch this.format {
+	case "list":
+		_, err = this.out.Write([]byte("[\n"))
+	case "map":
+		_, err = this.out.Write([]byte("{\n"))
+	}
+	return err
+}
+
+func (this *jsonWriter) write(hostAndPort string, obj interface{}) error {
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if this.format == "lines" {
+		if this.count != 0 {
+			out.WriteString("\n")
+		}
+		out.Write(buf)
+	} else {
+		if this.count != 0 {
+			out.WriteString(",\n")
+		}
+		out.WriteString("\t")
+		if this.format == "map" {
+			out.WriteString(fmt.Sprintf("\"%s\": ", hostAndPort))
+		}
+		json.Indent(&out, buf, "\t", "\t")
+	}
+	this.count++
+
+	_, err = out.WriteTo(this.out)
+	return err
+}
+
+func (this *jsonWriter) end() error {
+	var out bytes.Buffer
+	if this.count != 0 {
+		out.WriteString("\n")
+	}
+	switch this.format {
+	case "list":
+		out.WriteString("]\n")
+	case "map":
+		out.WriteString("}\n")
+	}
+
+	_, err := out.WriteTo(this.out)
+	return err
+}
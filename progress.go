@@ -0,0 +1,247 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	batch "github.com/alliedmodders/blaster/batch"
+	valve "github.com/alliedmodders/blaster/valve"
+)
+
+// Pages received from the master for one filter string.
+type filterProgress struct {
+	Filter string `json:"filter"`
+	Region string `json:"region"`
+	Pages  int    `json:"pages"`
+	Done   bool   `json:"done"`
+}
+
+// A snapshot of progress, which is also the format of -progress json.
+type progressReport struct {
+	Elapsed float64 `json:"elapsed"`
+
+	// Master query progress, which is empty with -targets.
+	MasterPages   int               `json:"master_pages"`
+	MasterFilters []*filterProgress `json:"master_filters,omitempty"`
+	FilterIndex   int               `json:"filter_index"`
+	NumFilters    int               `json:"num_filters"`
+
+	// Whether the full list of servers to query is known.
+	ListComplete bool `json:"list_complete"`
+
+	Discovered int64 `json:"discovered"`
+	Queued     int   `json:"queued"`
+	Running    int   `json:"running"`
+	Completed  int64 `json:"completed"`
+	Failed     int64 `json:"failed"`
+	Skipped    int64 `json:"skipped"`
+
+	// Estimated seconds until every server has been queried. This is only
+	// known once the list is complete.
+	Eta *float64 `json:"eta,omitempty"`
+
+	// Set on the last report.
+	Done bool `json:"done,omitempty"`
+}
+
+// Periodically reports progress on stderr.
+type progressReporter struct {
+	out      io.Writer
+	json     bool
+	terminal bool
+	interval time.Duration
+	bp       *batch.BatchProcessor
+	started  time.Time
+
+	lock         sync.Mutex
+	pages        int
+	filters      []*filterProgress
+	filterIndex  int
+	numFilters   int
+	listComplete bool
+
+	quit    chan bool
+	stopped chan bool
+}
+
+func newProgressReporter(out *os.File, asJson bool, interval time.Duration) *progressReporter {
+	// Redraw a single line on a terminal. Otherwise, print a line now and
+	// then, which is friendlier to log files.
+	terminal := false
+	if info, err := out.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		terminal = !asJson
+	}
+	if interval == 0 {
+		interval = time.Second * 10
+		if terminal {
+			interval = time.Second
+		}
+	}
+
+	return &progressReporter{
+		out:      out,
+		json:     asJson,
+		terminal: terminal,
+		interval: interval,
+		started:  time.Now(),
+		quit:     make(chan bool),
+		stopped:  make(chan bool),
+	}
+}
+
+// Used as the master's page callback.
+func (this *progressReporter) onPage(page *valve.MasterPage) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.pages++
+	this.filterIndex = page.FilterIndex
+	this.numFilters = page.NumFilters
+
+	region := page.Region.String()
+	var filter *filterProgress
+	for _, existing := range this.filters {
+		if existing.Filter == page.Filter && existing.Region == region {
+			filter = existing
+			break
+		}
+	}
+	if filter == nil {
+		filter = &filterProgress{Filter: page.Filter, Region: region}
+		this.filters = append(this.filters, filter)
+	}
+	filter.Pages++
+	filter.Done = page.Done
+}
+
+// Called once every server to be queried has been added to the batch
+// processor.
+func (this *progressReporter) setListComplete() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.listComplete = true
+}
+
+func (this *progressReporter) snapshot() *progressReport {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	report := &progressReport{
+		Elapsed:      time.Since(this.started).Seconds(),
+		MasterPages:  this.pages,
+		FilterIndex:  this.filterIndex,
+		NumFilters:   this.numFilters,
+		ListComplete: this.listComplete,
+		Discovered:   atomic.LoadInt64(&sNumDiscovered),
+		Completed:    atomic.LoadInt64(&sNumCompleted),
+		Failed:       atomic.LoadInt64(&sNumFailed),
+		Skipped:      atomic.LoadInt64(&sNumSkipped),
+	}
+	for _, filter := range this.filters {
+		copied := *filter
+		report.MasterFilters = append(report.MasterFilters, &copied)
+	}
+	if this.bp != nil {
+		report.Queued, report.Running = this.bp.Stats()
+	}
+
+	// Estimate from the average rate so far.
+	if report.ListComplete && report.Completed > 0 {
+		remaining := report.Discovered - report.Completed - report.Skipped
+		eta := report.Elapsed / float64(report.Completed) * float64(remaining)
+		report.Eta = &eta
+	}
+	return report
+}
+
+func formatSeconds(seconds float64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+func (this *progressReporter) formatText(report *progressReport) string {
+	parts := []string{}
+	if report.NumFilters > 0 {
+		master := fmt.Sprintf("master: %d pages", report.MasterPages)
+		if !report.ListComplete {
+			current := report.MasterFilters[len(report.MasterFilters)-1]
+			master += fmt.Sprintf(" (filter %d/%d, %d pages)", report.FilterIndex+1, report.NumFilters, current.Pages)
+		}
+		parts = append(parts, master)
+	}
+	parts = append(parts, fmt.Sprintf("servers: %d found, %d queued, %d running, %d done, %d failed",
+		report.Discovered, report.Queued, report.Running, report.Completed, report.Failed))
+	if report.Skipped > 0 {
+		parts = append(parts, fmt.Sprintf("%d skipped", report.Skipped))
+	}
+
+	elapsed := fmt.Sprintf("%s elapsed", formatSeconds(report.Elapsed))
+	if report.Eta != nil && !report.Done {
+		elapsed += fmt.Sprintf(", eta %s", formatSeconds(*report.Eta))
+	}
+	return strings.Join(append(parts, elapsed), " | ")
+}
+
+func (this *progressReporter) print(report *progressReport) {
+	if this.json {
+		buf, err := json.Marshal(report)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Fprintf(this.out, "%s\n", buf)
+		return
+	}
+
+	line := this.formatText(report)
+	if !this.terminal {
+		fmt.Fprintf(this.out, "%s\n", line)
+		return
+	}
+
+	// Overwrite the previous line, and finish it on the last report.
+	fmt.Fprintf(this.out, "\r\033[K%s", line)
+	if report.Done {
+		fmt.Fprintf(this.out, "\n")
+	}
+}
+
+// Start reporting progress on the batch processor's queue.
+func (this *progressReporter) start(bp *batch.BatchProcessor) {
+	this.bp = bp
+
+	go (func() {
+		defer close(this.stopped)
+
+		ticker := time.NewTicker(this.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				this.print(this.snapshot())
+			case <-this.quit:
+				report := this.snapshot()
+				report.Done = true
+				this.print(report)
+				return
+			}
+		}
+	})()
+}
+
+// Stop reporting, after printing a final report.
+func (this *progressReporter) stop() {
+	close(this.quit)
+	<-this.stopped
+}
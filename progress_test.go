@@ -0,0 +1,170 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	valve "github.com/alliedmodders/blaster/valve"
+)
+
+// Set the global server counts for a test, restoring them afterward.
+func setServerCounts(t *testing.T, discovered, completed, failed, skipped int64) {
+	saved := []int64{sNumDiscovered, sNumCompleted, sNumFailed, sNumSkipped}
+	t.Cleanup(func() {
+		sNumDiscovered, sNumCompleted, sNumFailed, sNumSkipped = saved[0], saved[1], saved[2], saved[3]
+	})
+	sNumDiscovered, sNumCompleted, sNumFailed, sNumSkipped = discovered, completed, failed, skipped
+}
+
+func TestProgressFormatText(t *testing.T) {
+	eta := 20.9
+	cases := []struct {
+		report   progressReport
+		expected string
+	}{
+		{
+			// With -targets, there is no master progress.
+			progressReport{Elapsed: 3.5, ListComplete: true, Discovered: 5, Queued: 1, Running: 2, Completed: 2},
+			"servers: 5 found, 1 queued, 2 running, 2 done, 0 failed | 3s elapsed",
+		},
+		{
+			progressReport{
+				Elapsed:       65.7,
+				MasterPages:   5,
+				MasterFilters: []*filterProgress{{Pages: 2, Done: true}, {Pages: 3}},
+				FilterIndex:   1,
+				NumFilters:    2,
+				Discovered:    1000,
+				Queued:        900,
+				Running:       20,
+				Completed:     80,
+				Failed:        4,
+			},
+			"master: 5 pages (filter 2/2, 3 pages) | servers: 1000 found, 900 queued, 20 running, 80 done, 4 failed | 1m5s elapsed",
+		},
+		{
+			progressReport{
+				Elapsed:       10,
+				MasterPages:   5,
+				MasterFilters: []*filterProgress{{Pages: 5, Done: true}},
+				NumFilters:    1,
+				ListComplete:  true,
+				Discovered:    30,
+				Completed:     10,
+				Failed:        1,
+				Skipped:       4,
+				Eta:           &eta,
+			},
+			"master: 5 pages | servers: 30 found, 0 queued, 0 running, 10 done, 1 failed | 4 skipped | 10s elapsed, eta 20s",
+		},
+		{
+			// The last report has no estimate.
+			progressReport{Elapsed: 12, ListComplete: true, Discovered: 30, Completed: 30, Eta: &eta, Done: true},
+			"servers: 30 found, 0 queued, 0 running, 30 done, 0 failed | 12s elapsed",
+		},
+	}
+
+	reporter := &progressReporter{}
+	for _, test := range cases {
+		if got := reporter.formatText(&test.report); got != test.expected {
+			t.Errorf("got %q, expected %q", got, test.expected)
+		}
+	}
+}
+
+func TestProgressSnapshot(t *testing.T) {
+	setServerCounts(t, 10, 4, 1, 2)
+
+	reporter := &progressReporter{started: time.Now().Add(-time.Second * 10)}
+	reporter.onPage(&valve.MasterPage{FilterIndex: 0, NumFilters: 2, Region: valve.Region_Europe, Filter: `\appid\440`})
+	reporter.onPage(&valve.MasterPage{FilterIndex: 0, NumFilters: 2, Region: valve.Region_Europe, Filter: `\appid\440`, Done: true})
+	reporter.onPage(&valve.MasterPage{FilterIndex: 1, NumFilters: 2, Region: valve.Region_Europe, Filter: `\appid\240`})
+
+	report := reporter.snapshot()
+	if report.MasterPages != 3 || report.FilterIndex != 1 || report.NumFilters != 2 {
+		t.Errorf("got %d pages, filter %d/%d", report.MasterPages, report.FilterIndex, report.NumFilters)
+	}
+	if len(report.MasterFilters) != 2 ||
+		*report.MasterFilters[0] != (filterProgress{Filter: `\appid\440`, Region: "europe", Pages: 2, Done: true}) ||
+		*report.MasterFilters[1] != (filterProgress{Filter: `\appid\240`, Region: "europe", Pages: 1}) {
+		t.Errorf("got filters %+v", report.MasterFilters)
+	}
+	if report.Discovered != 10 || report.Completed != 4 || report.Failed != 1 || report.Skipped != 2 {
+		t.Errorf("got %d found, %d done, %d failed, %d skipped",
+			report.Discovered, report.Completed, report.Failed, report.Skipped)
+	}
+
+	// More servers may still arrive, so there is no estimate yet.
+	if report.ListComplete || report.Eta != nil {
+		t.Errorf("expected no estimate before the list is complete")
+	}
+
+	// 4 servers took 10 seconds, so the 4 that are left should take as long.
+	reporter.setListComplete()
+	report = reporter.snapshot()
+	if !report.ListComplete || report.Eta == nil {
+		t.Fatalf("expected an estimate once the list is complete")
+	}
+	if math.Abs(*report.Eta-10) > 1 {
+		t.Errorf("got eta %v, expected about 10", *report.Eta)
+	}
+
+	// Snapshots are not changed by later pages.
+	reporter.onPage(&valve.MasterPage{FilterIndex: 1, NumFilters: 2, Region: valve.Region_Europe, Filter: `\appid\240`})
+	if report.MasterFilters[1].Pages != 1 {
+		t.Errorf("expected the snapshot to be a copy")
+	}
+}
+
+func TestProgressJson(t *testing.T) {
+	setServerCounts(t, 3, 1, 0, 0)
+
+	var out bytes.Buffer
+	reporter := &progressReporter{
+		out:      &out,
+		json:     true,
+		interval: time.Millisecond * 10,
+		started:  time.Now(),
+		quit:     make(chan bool),
+		stopped:  make(chan bool),
+	}
+	reporter.start(nil)
+	time.Sleep(time.Millisecond * 50)
+	reporter.setListComplete()
+	reporter.stop()
+
+	// Each report is a single JSON object on its own line, and only the last
+	// is marked done.
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("expected several reports, got:\n%s", out.String())
+	}
+	for i, line := range lines {
+		report := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &report); err != nil {
+			t.Fatalf("line %d is not a JSON object: %v\n%s", i+1, err, line)
+		}
+		if report["discovered"] != 3.0 || report["completed"] != 1.0 {
+			t.Errorf("line %d: got %v", i+1, report)
+		}
+		last := i == len(lines)-1
+		if (report["done"] == true) != last {
+			t.Errorf("line %d: got done %v", i+1, report["done"])
+		}
+		if _, ok := report["master_filters"]; ok {
+			t.Errorf("line %d: expected no master filters without pages, got %v", i+1, report)
+		}
+		if _, ok := report["eta"]; last && (!ok || report["list_complete"] != true) {
+			t.Errorf("expected the last report to have an estimate, got %v", report)
+		}
+	}
+}
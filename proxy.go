@@ -0,0 +1,151 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	valve "github.com/alliedmodders/blaster/valve"
+)
+
+// Periodically queries an upstream server and updates the responder's cache.
+type proxyRefresher struct {
+	query     *valve.ServerQuerier
+	responder *valve.Responder
+	rules     bool
+	players   bool
+	maxAge    time.Duration
+	lastReply time.Time
+	down      bool
+}
+
+func (this *proxyRefresher) refresh(ctx context.Context) {
+	info, err := this.query.QueryInfoContext(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		if !this.down {
+			fmt.Fprintf(os.Stderr, "Could not query upstream server: %s\n", err.Error())
+			this.down = true
+		}
+
+		// Stop answering once the cache is too old, so the server drops out of
+		// server browsers rather than advertising stale information.
+		if this.maxAge > 0 && time.Since(this.lastReply) > this.maxAge {
+			this.responder.SetInfo(nil)
+		}
+		return
+	}
+
+	if this.down {
+		fmt.Fprintf(os.Stderr, "Upstream server is replying again.\n")
+		this.down = false
+	}
+	this.lastReply = time.Now()
+
+	// Some servers refuse rules or player queries, in which case the last
+	// successful reply (if any) is kept.
+	if this.rules {
+		if rules, err := this.query.QueryRulesContext(ctx); err == nil {
+			this.responder.SetRules(rules)
+		}
+	}
+	if this.players {
+		if players, err := this.query.QueryPlayersContext(ctx); err == nil {
+			this.responder.SetPlayers(players)
+		}
+	}
+	this.responder.SetInfo(info)
+}
+
+// Run "blaster proxy", which answers A2S queries from a cache of an upstream
+// server's replies.
+func runProxy(args []string) {
+	flags := flag.NewFlagSet("proxy", flag.ExitOnError)
+	flag_upstream := flags.String("upstream", "", "Address of the game server to query")
+	flag_listen := flags.String("listen", "", "Address to answer queries on")
+	flag_interval := flags.Duration("interval", time.Second*5, "How often to query the upstream server")
+	flag_timeout := flags.Duration("timeout", time.Second*3, "Timeout for querying the upstream server")
+	flag_maxage := flags.Duration("maxage", time.Second*30, "Stop answering queries if the upstream server has not replied for this long (0 to always answer)")
+	flag_norules := flags.Bool("norules", false, "Don't query or answer with server rules")
+	flag_noplayers := flags.Bool("noplayers", false, "Don't query or answer with the player list")
+	flag_challengeinfo := flags.Bool("challengeinfo", true, "Require a challenge for A2S_INFO, which prevents reflection attacks")
+	flag_compress := flags.Bool("compress", false, "Compress large replies, for Source servers that support it")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: blaster proxy -upstream <address> -listen <address>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *flag_upstream == "" || *flag_listen == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	query, err := valve.NewServerQuerier(*flag_upstream, *flag_timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not connect to upstream server: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer query.Close()
+
+	// Nothing is answered until the first upstream reply.
+	responder, err := valve.NewResponder(nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create responder: %s\n", err.Error())
+		os.Exit(1)
+	}
+	responder.SetChallengeInfo(*flag_challengeinfo)
+	responder.SetCompression(*flag_compress)
+	responder.SetAnswerRules(!*flag_norules)
+	responder.SetAnswerPlayers(!*flag_noplayers)
+
+	conn, err := net.ListenPacket("udp", *flag_listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not listen on %s: %s\n", *flag_listen, err.Error())
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	refresher := &proxyRefresher{
+		query:     query,
+		responder: responder,
+		rules:     !*flag_norules,
+		players:   !*flag_noplayers,
+		maxAge:    *flag_maxage,
+	}
+	go (func() {
+		ticker := time.NewTicker(*flag_interval)
+		defer ticker.Stop()
+
+		for {
+			refresher.refresh(ctx)
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				conn.Close()
+				return
+			}
+		}
+	})()
+
+	fmt.Fprintf(os.Stderr, "Answering queries for %s on %s.\n", *flag_upstream, conn.LocalAddr().String())
+	if err := responder.Serve(conn); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not answer queries: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,120 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	valve "github.com/alliedmodders/blaster/valve"
+	valvetest "github.com/alliedmodders/blaster/valve/valvetest"
+)
+
+func TestProxy(t *testing.T) {
+	upstream := valvetest.NewFakeServer(&valve.ServerInfo{
+		InfoVersion: valve.S2A_INFO_SOURCE,
+		Protocol:    17,
+		Name:        "Upstream",
+		MapName:     "ctf_2fort",
+		Folder:      "tf",
+		Game:        "Team Fortress",
+		Players:     1,
+		MaxPlayers:  24,
+		Type:        valve.ServerType_Dedicated,
+		OS:          valve.ServerOS_Linux,
+		Ext:         &valve.ExtendedInfo{AppId: valve.App_TF2, GameVersion: "1.0", GameId: uint64(valve.App_TF2)},
+	})
+	upstream.Rules = map[string]string{"mp_timelimit": "30", "sv_cheats": "0"}
+	upstream.Players = []*valve.PlayerInfo{{Index: 0, Name: "Scout", Score: 10, Duration: 12.5}}
+	upstream.ChallengeInfo = true
+	if err := upstream.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	// Set up the proxy as runProxy does.
+	upstreamQuery, err := valve.NewServerQuerier(upstream.Addr(), time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstreamQuery.Close()
+
+	responder, err := valve.NewResponder(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder.SetChallengeInfo(true)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go responder.Serve(conn)
+
+	refresher := &proxyRefresher{
+		query:     upstreamQuery,
+		responder: responder,
+		rules:     true,
+		players:   true,
+		maxAge:    time.Millisecond * 100,
+	}
+	refresher.refresh(context.Background())
+
+	// Clients of the proxy see the upstream server's replies.
+	query, err := valve.NewServerQuerier(conn.LocalAddr().String(), time.Millisecond*500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer query.Close()
+
+	info, err := query.QueryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Address, info.Ping, info.ChallengePing = "", 0, 0
+	if !reflect.DeepEqual(info, upstream.Info) {
+		t.Errorf("got info %+v, expected %+v", info, upstream.Info)
+	}
+	rules, err := query.QueryRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rules, upstream.Rules) {
+		t.Errorf("got rules %v, expected %v", rules, upstream.Rules)
+	}
+	players, err := query.QueryPlayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(players, upstream.Players) {
+		t.Errorf("got players %+v, expected %+v", players, upstream.Players)
+	}
+
+	// The proxy answers from its cache, without querying upstream again.
+	requests := upstream.Requests()
+	if _, err := query.QueryInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if upstream.Requests() != requests {
+		t.Errorf("expected no upstream requests, got %d", upstream.Requests()-requests)
+	}
+
+	// Once upstream has been gone for longer than maxAge, the proxy stops
+	// answering.
+	upstream.Close()
+	time.Sleep(refresher.maxAge)
+	refresher.refresh(context.Background())
+	if !refresher.down {
+		t.Errorf("expected upstream to be down")
+	}
+	if _, err := query.QueryInfo(); err == nil {
+		t.Errorf("expected no reply once the cache is too old")
+	}
+}
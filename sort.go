@@ -0,0 +1,136 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Compares two servers, returning a negative number if a sorts first.
+type sortKey func(a *ServerObject, b *ServerObject) int
+
+var kSortKeys = map[string]sortKey{
+	// Busiest servers first.
+	"players": func(a *ServerObject, b *ServerObject) int {
+		return int(b.Players) - int(a.Players)
+	},
+	"name": func(a *ServerObject, b *ServerObject) int {
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	},
+	"map": func(a *ServerObject, b *ServerObject) int {
+		return strings.Compare(a.MapName, b.MapName)
+	},
+	"latency": comparePings,
+	"ping":    comparePings,
+	"address": func(a *ServerObject, b *ServerObject) int {
+		return compareAddresses(a.Address, b.Address)
+	},
+}
+
+// Lowest ping first.
+func comparePings(a *ServerObject, b *ServerObject) int {
+	switch {
+	case a.Ping < b.Ping:
+		return -1
+	case a.Ping > b.Ping:
+		return 1
+	}
+	return 0
+}
+
+// Compare two host:port strings by IP address, then port.
+func compareAddresses(a string, b string) int {
+	aHost, aPort, _ := net.SplitHostPort(a)
+	bHost, bPort, _ := net.SplitHostPort(b)
+	aIp, bIp := net.ParseIP(aHost), net.ParseIP(bHost)
+	if aIp == nil || bIp == nil {
+		return strings.Compare(a, b)
+	}
+	if cmp := bytes.Compare(aIp.To16(), bIp.To16()); cmp != 0 {
+		return cmp
+	}
+
+	x, _ := strconv.Atoi(aPort)
+	y, _ := strconv.Atoi(bPort)
+	return x - y
+}
+
+// Parse a comma-delimited list of sort keys. Later keys break ties in
+// earlier ones.
+func parseSortKeys(list string) ([]sortKey, error) {
+	keys := []sortKey{}
+	for _, name := range strings.Split(list, ",") {
+		key, ok := kSortKeys[name]
+		if !ok {
+			return nil, fmt.Errorf("\"%s\" is not a valid sort key (players, name, map, latency, address)", name)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+type pendingResult struct {
+	hostAndPort string
+	obj         interface{}
+}
+
+// Holds every result until the end, then writes them in sorted order. Servers
+// that failed are written last, by address.
+type sortingWriter struct {
+	inner   outputWriter
+	keys    []sortKey
+	results []pendingResult
+}
+
+func newSortingWriter(inner outputWriter, keys []sortKey) *sortingWriter {
+	return &sortingWriter{
+		inner: inner,
+		keys:  keys,
+	}
+}
+
+func (this *sortingWriter) begin() error {
+	return this.inner.begin()
+}
+
+func (this *sortingWriter) write(hostAndPort string, obj interface{}) error {
+	this.results = append(this.results, pendingResult{hostAndPort, obj})
+	return nil
+}
+
+func (this *sortingWriter) less(a pendingResult, b pendingResult) bool {
+	aServer, aOk := a.obj.(*ServerObject)
+	bServer, bOk := b.obj.(*ServerObject)
+	if aOk != bOk {
+		return aOk
+	}
+	if aOk {
+		for _, key := range this.keys {
+			if cmp := key(aServer, bServer); cmp != 0 {
+				return cmp < 0
+			}
+		}
+	}
+	return compareAddresses(a.hostAndPort, b.hostAndPort) < 0
+}
+
+func (this *sortingWriter) end() error {
+	sort.SliceStable(this.results, func(i, j int) bool {
+		return this.less(this.results[i], this.results[j])
+	})
+
+	for _, result := range this.results {
+		if err := this.inner.write(result.hostAndPort, result.obj); err != nil {
+			return err
+		}
+	}
+	return this.inner.end()
+}
@@ -0,0 +1,89 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Records the addresses written, in order.
+type recordingWriter struct {
+	addresses []string
+	ended     bool
+}
+
+func (this *recordingWriter) begin() error {
+	return nil
+}
+
+func (this *recordingWriter) write(hostAndPort string, obj interface{}) error {
+	this.addresses = append(this.addresses, hostAndPort)
+	return nil
+}
+
+func (this *recordingWriter) end() error {
+	this.ended = true
+	return nil
+}
+
+func TestSortingWriter(t *testing.T) {
+	server := func(address string, name string, mapName string, players uint8, ping float64) *ServerObject {
+		obj := testServer()
+		obj.Address, obj.Name, obj.MapName, obj.Players, obj.Ping = address, name, mapName, players, ping
+		return obj
+	}
+	failed := func(address string) *ErrorObject {
+		obj := testError()
+		obj.Ip = address
+		return obj
+	}
+	results := []interface{}{
+		failed("10.0.0.10:27015"),
+		server("10.0.0.9:27015", "charlie", "ctf_2fort", 4, 30),
+		server("10.0.0.2:27016", "Alpha", "pl_badwater", 20, 10),
+		failed("10.0.0.3:27015"),
+		server("10.0.0.2:27015", "bravo", "ctf_2fort", 4, 20),
+		server("10.0.0.10:27015", "delta", "ctf_2fort", 12, 5),
+	}
+
+	cases := []struct {
+		keys     string
+		expected []string
+	}{
+		{"players", []string{"10.0.0.2:27016", "10.0.0.10:27015", "10.0.0.2:27015", "10.0.0.9:27015"}},
+		{"name", []string{"10.0.0.2:27016", "10.0.0.2:27015", "10.0.0.9:27015", "10.0.0.10:27015"}},
+		{"latency", []string{"10.0.0.10:27015", "10.0.0.2:27016", "10.0.0.2:27015", "10.0.0.9:27015"}},
+		{"address", []string{"10.0.0.2:27015", "10.0.0.2:27016", "10.0.0.9:27015", "10.0.0.10:27015"}},
+		{"map,players", []string{"10.0.0.10:27015", "10.0.0.2:27015", "10.0.0.9:27015", "10.0.0.2:27016"}},
+	}
+	for _, test := range cases {
+		keys, err := parseSortKeys(test.keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := &recordingWriter{}
+		writeResults(t, newSortingWriter(recorder, keys), results...)
+
+		// Failed servers are always last, by address.
+		expected := append(test.expected, "10.0.0.3:27015", "10.0.0.10:27015")
+		if fmt.Sprint(recorder.addresses) != fmt.Sprint(expected) {
+			t.Errorf("-sort %s: got %v, expected %v", test.keys, recorder.addresses, expected)
+		}
+		if !recorder.ended {
+			t.Errorf("-sort %s: expected the output to be ended", test.keys)
+		}
+	}
+}
+
+func TestParseSortKeys(t *testing.T) {
+	if _, err := parseSortKeys("players,bogus"); err == nil {
+		t.Errorf("expected an error for an unknown key")
+	}
+	if keys, err := parseSortKeys("ping,name"); err != nil || len(keys) != 2 {
+		t.Errorf("got %d keys, %v", len(keys), err)
+	}
+}
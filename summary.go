@@ -0,0 +1,207 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The dimensions used for "-summary all".
+var kSummaryDefaults = []string{"appid", "map", "os", "type", "vac", "game_version"}
+
+type summaryCounts struct {
+	Servers    int `json:"servers"`
+	Failed     int `json:"failed"`
+	Players    int `json:"players"`
+	Bots       int `json:"bots"`
+	MaxPlayers int `json:"max_players"`
+}
+
+func (this *summaryCounts) add(server *ServerObject) {
+	this.Servers++
+	this.Players += int(server.Players)
+	this.Bots += int(server.Bots)
+	this.MaxPlayers += int(server.MaxPlayers)
+}
+
+type summaryRow struct {
+	Value string `json:"value"`
+	summaryCounts
+}
+
+// Parse a comma-delimited list of dimensions to summarize by. Any table
+// column can be used except rules and player_list.
+func parseSummaryDimensions(list string) ([]string, error) {
+	if list == "all" {
+		return kSummaryDefaults, nil
+	}
+
+	columns := tableColumns()
+	dimensions := strings.Split(list, ",")
+	for _, dimension := range dimensions {
+		if dimension == "rules" || dimension == "player_list" || !containsString(columns, dimension) {
+			return nil, fmt.Errorf("cannot summarize by \"%s\"", dimension)
+		}
+	}
+	return dimensions, nil
+}
+
+// Counts servers and players for each value of the chosen dimensions, such as
+// each map or each AppID, and writes the tables at the end. Dimensions from
+// ErrorDetails, such as "code", count failed servers instead.
+type summaryWriter struct {
+	out        io.Writer
+	format     string
+	dimensions []string
+	errorDims  []string
+	total      summaryCounts
+	groups     map[string]map[string]*summaryRow
+}
+
+func newSummaryWriter(out io.Writer, format string, dimensions []string) *summaryWriter {
+	groups := map[string]map[string]*summaryRow{}
+	for _, dimension := range dimensions {
+		groups[dimension] = map[string]*summaryRow{}
+	}
+	return &summaryWriter{
+		out:        out,
+		format:     format,
+		dimensions: dimensions,
+		errorDims:  flattenType("", reflect.TypeOf(ErrorDetails{})),
+		groups:     groups,
+	}
+}
+
+func (this *summaryWriter) begin() error {
+	return nil
+}
+
+func (this *summaryWriter) row(dimension string, value string) *summaryRow {
+	row, ok := this.groups[dimension][value]
+	if !ok {
+		row = &summaryRow{Value: value}
+		this.groups[dimension][value] = row
+	}
+	return row
+}
+
+func (this *summaryWriter) write(hostAndPort string, obj interface{}) error {
+	cells := map[string]string{}
+	flattenValue("", reflect.ValueOf(obj).Elem(), cells)
+
+	server, ok := obj.(*ServerObject)
+	if !ok {
+		this.total.Failed++
+		for _, dimension := range this.dimensions {
+			if containsString(this.errorDims, dimension) {
+				this.row(dimension, cells[dimension]).Failed++
+			}
+		}
+		return nil
+	}
+
+	this.total.add(server)
+	for _, dimension := range this.dimensions {
+		if !containsString(this.errorDims, dimension) {
+			this.row(dimension, cells[dimension]).add(server)
+		}
+	}
+	return nil
+}
+
+// Rows for a dimension, most common first.
+func (this *summaryWriter) sortedRows(dimension string) []*summaryRow {
+	rows := []*summaryRow{}
+	for _, row := range this.groups[dimension] {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.Servers+a.Failed != b.Servers+b.Failed {
+			return a.Servers+a.Failed > b.Servers+b.Failed
+		}
+		return a.Value < b.Value
+	})
+	return rows
+}
+
+func (this *summaryWriter) end() error {
+	switch this.format {
+	case "csv", "tsv":
+		return this.writeTable()
+	}
+	return this.writeJson()
+}
+
+// Write one long table, with the totals first as dimension "total".
+func (this *summaryWriter) writeTable() error {
+	delimiter := ','
+	if this.format == "tsv" {
+		delimiter = '\t'
+	}
+	writer := newCsvWriter(this.out, delimiter)
+
+	format := func(dimension string, row *summaryRow) []string {
+		return []string{
+			dimension,
+			row.Value,
+			strconv.Itoa(row.Servers),
+			strconv.Itoa(row.Failed),
+			strconv.Itoa(row.Players),
+			strconv.Itoa(row.Bots),
+			strconv.Itoa(row.MaxPlayers),
+		}
+	}
+
+	writer.Write([]string{"dimension", "value", "servers", "failed", "players", "bots", "max_players"})
+	writer.Write(format("total", &summaryRow{summaryCounts: this.total}))
+	for _, dimension := range this.dimensions {
+		for _, row := range this.sortedRows(dimension) {
+			writer.Write(format(dimension, row))
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Write an object with the totals, then a list of rows for each dimension in
+// the order given.
+func (this *summaryWriter) writeJson() error {
+	var buf bytes.Buffer
+	total, err := json.Marshal(&this.total)
+	if err != nil {
+		return err
+	}
+	buf.WriteString("{\"total\":")
+	buf.Write(total)
+	for _, dimension := range this.dimensions {
+		rows, err := json.Marshal(this.sortedRows(dimension))
+		if err != nil {
+			return err
+		}
+		buf.WriteString(fmt.Sprintf(",\"%s\":", dimension))
+		buf.Write(rows)
+	}
+	buf.WriteString("}")
+
+	var out bytes.Buffer
+	if this.format == "lines" {
+		buf.WriteTo(&out)
+	} else {
+		json.Indent(&out, buf.Bytes(), "", "\t")
+	}
+	out.WriteString("\n")
+
+	_, err = out.WriteTo(this.out)
+	return err
+}
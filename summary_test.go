@@ -0,0 +1,63 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func summaryResults() []interface{} {
+	busy := testServer()
+	busy.Address, busy.MapName, busy.Players = "10.0.0.2:27015", "pl_badwater", 20
+	quiet := testServer()
+	quiet.Address, quiet.Players = "10.0.0.3:27015", 4
+	refused := testError()
+	refused.Ip, refused.Code = "10.0.0.4:27015", "connection_refused"
+	return []interface{}{testServer(), busy, testError(), quiet, refused}
+}
+
+func TestSummaryJson(t *testing.T) {
+	var out bytes.Buffer
+	writeResults(t, newSummaryWriter(&out, "lines", []string{"map", "code"}), summaryResults()...)
+
+	expected := `{"total":{"servers":3,"failed":2,"players":36,"bots":6,"max_players":72},` +
+		`"map":[{"value":"ctf_2fort","servers":2,"failed":0,"players":16,"bots":4,"max_players":48},` +
+		`{"value":"pl_badwater","servers":1,"failed":0,"players":20,"bots":2,"max_players":24}],` +
+		`"code":[{"value":"connection_refused","servers":0,"failed":1,"players":0,"bots":0,"max_players":0},` +
+		`{"value":"timeout","servers":0,"failed":1,"players":0,"bots":0,"max_players":0}]}` + "\n"
+	if out.String() != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
+
+func TestSummaryTable(t *testing.T) {
+	var out bytes.Buffer
+	writeResults(t, newSummaryWriter(&out, "csv", []string{"map", "code"}), summaryResults()...)
+
+	expected := "dimension,value,servers,failed,players,bots,max_players\n" +
+		"total,,3,2,36,6,72\n" +
+		"map,ctf_2fort,2,0,16,4,48\n" +
+		"map,pl_badwater,1,0,20,2,24\n" +
+		"code,connection_refused,0,1,0,0,0\n" +
+		"code,timeout,0,1,0,0,0\n"
+	if out.String() != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
+
+func TestParseSummaryDimensions(t *testing.T) {
+	dimensions, err := parseSummaryDimensions("all")
+	if err != nil || fmt.Sprint(dimensions) != fmt.Sprint(kSummaryDefaults) {
+		t.Errorf("got %v, %v", dimensions, err)
+	}
+	for _, list := range []string{"map,bogus", "rules", "player_list"} {
+		if _, err := parseSummaryDimensions(list); err == nil {
+			t.Errorf("%s: expected an error", list)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	valve "github.com/alliedmodders/blaster/valve"
+)
+
+// Writes results as CSV or TSV, one row per server. Columns are named after
+// the JSON keys of ServerObject, in the same order, with nested objects such
+// as "mod" flattened into columns like "mod_url". Rules and players are either
+// JSON-encoded cells, or rows in separate long-format tables.
+type tableWriter struct {
+	out     *csv.Writer
+	columns []string
+	rules   *csv.Writer
+	players *csv.Writer
+}
+
+// Every column that can appear in a table, in order.
+func tableColumns() []string {
+	columns := flattenType("", reflect.TypeOf(ServerObject{}))
+	return append(columns, flattenType("", reflect.TypeOf(ErrorDetails{}))...)
+}
+
+// Parse a comma-delimited list of column names. If the list is empty, every
+// column is returned except for those in omit.
+func parseColumns(list string, omit ...string) ([]string, error) {
+	all := tableColumns()
+	if list == "" {
+		columns := []string{}
+		for _, column := range all {
+			if !containsString(omit, column) {
+				columns = append(columns, column)
+			}
+		}
+		return columns, nil
+	}
+
+	columns := strings.Split(list, ",")
+	for _, column := range columns {
+		if !containsString(all, column) {
+			return nil, fmt.Errorf("unknown column \"%s\" (valid columns: %s)", column, strings.Join(all, ","))
+		}
+	}
+	return columns, nil
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+func newTableWriter(out io.Writer, delimiter rune, columns []string) *tableWriter {
+	return &tableWriter{
+		out:     newCsvWriter(out, delimiter),
+		columns: columns,
+	}
+}
+
+func newCsvWriter(out io.Writer, delimiter rune) *csv.Writer {
+	writer := csv.NewWriter(out)
+	writer.Comma = delimiter
+	return writer
+}
+
+// Write rules to a separate table with one row per rule, instead of as a
+// JSON-encoded cell.
+func (this *tableWriter) setRulesOutput(out io.Writer) {
+	this.rules = newCsvWriter(out, this.out.Comma)
+}
+
+// Write players to a separate table with one row per player, instead of as a
+// JSON-encoded cell.
+func (this *tableWriter) setPlayersOutput(out io.Writer) {
+	this.players = newCsvWriter(out, this.out.Comma)
+}
+
+// Write the header row of each table.
+func (this *tableWriter) begin() error {
+	if err := this.writeRow(this.out, this.columns); err != nil {
+		return err
+	}
+	if this.rules != nil {
+		if err := this.writeRow(this.rules, []string{"ip", "name", "value"}); err != nil {
+			return err
+		}
+	}
+	if this.players != nil {
+		header := append([]string{"ip"}, flattenType("", reflect.TypeOf(valve.PlayerInfo{}))...)
+		if err := this.writeRow(this.players, header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *tableWriter) write(hostAndPort string, obj interface{}) error {
+	cells := map[string]string{}
+	flattenValue("", reflect.ValueOf(obj).Elem(), cells)
+
+	row := make([]string, len(this.columns))
+	for i, column := range this.columns {
+		row[i] = cells[column]
+	}
+	if err := this.writeRow(this.out, row); err != nil {
+		return err
+	}
+
+	server, ok := obj.(*ServerObject)
+	if !ok {
+		return nil
+	}
+	if rules, ok := server.Rules.(map[string]string); ok && this.rules != nil {
+		names := []string{}
+		for name := range rules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if err := this.writeRow(this.rules, []string{server.Address, name, rules[name]}); err != nil {
+				return err
+			}
+		}
+	}
+	if players, ok := server.PlayerList.([]*valve.PlayerInfo); ok && this.players != nil {
+		columns := flattenType("", reflect.TypeOf(valve.PlayerInfo{}))
+		for _, player := range players {
+			cells := map[string]string{}
+			flattenValue("", reflect.ValueOf(player).Elem(), cells)
+
+			row := []string{server.Address}
+			for _, column := range columns {
+				row = append(row, cells[column])
+			}
+			if err := this.writeRow(this.players, row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (this *tableWriter) end() error {
+	return nil
+}
+
+// Rows are flushed as they are written, so a long crawl produces output as it
+// goes, like the JSON formats.
+func (this *tableWriter) writeRow(writer *csv.Writer, row []string) error {
+	if err := writer.Write(row); err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Split a JSON struct tag into its name and whether it has omitempty.
+func jsonTag(field reflect.StructField) (string, bool) {
+	name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, strings.Contains(options, "omitempty")
+}
+
+// Whether a field is a nested object that is flattened into several columns.
+func isNestedStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct
+}
+
+func flattenType(prefix string, t reflect.Type) []string {
+	columns := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			columns = append(columns, flattenType(prefix, field.Type)...)
+			continue
+		}
+
+		name, _ := jsonTag(field)
+		if name == "-" {
+			continue
+		}
+		if isNestedStruct(field.Type) {
+			columns = append(columns, flattenType(prefix+name+"_", field.Type.Elem())...)
+			continue
+		}
+		columns = append(columns, prefix+name)
+	}
+	return columns
+}
+
+// Fill in cells for a struct value, leaving out empty fields the same way
+// encoding/json would.
+func flattenValue(prefix string, v reflect.Value, cells map[string]string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+		if field.Anonymous {
+			flattenValue(prefix, value, cells)
+			continue
+		}
+
+		name, omitEmpty := jsonTag(field)
+		if name == "-" {
+			continue
+		}
+		if isNestedStruct(field.Type) {
+			if !value.IsNil() {
+				flattenValue(prefix+name+"_", value.Elem(), cells)
+			}
+			continue
+		}
+		if omitEmpty && value.IsZero() {
+			continue
+		}
+		cells[prefix+name] = formatCell(value)
+	}
+}
+
+func formatCell(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, v.Type().Bits())
+	case reflect.String:
+		return v.String()
+	case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			return ""
+		}
+	}
+
+	buf, err := json.Marshal(v.Interface())
+	if err != nil {
+		panic(err)
+	}
+	return string(buf)
+}
@@ -0,0 +1,144 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	valve "github.com/alliedmodders/blaster/valve"
+)
+
+func testServer() *ServerObject {
+	return &ServerObject{
+		Address:     "10.0.0.1:27015",
+		Protocol:    17,
+		Name:        "Test, \"quoted\"",
+		MapName:     "ctf_2fort",
+		Folder:      "tf",
+		Game:        "Team Fortress",
+		Players:     12,
+		MaxPlayers:  24,
+		Bots:        2,
+		Type:        "dedicated",
+		Os:          "linux",
+		Visibility:  "public",
+		Vac:         true,
+		Ping:        12.5,
+		AppId:       valve.App_TF2,
+		GameVersion: "1.0.0.0",
+		Port:        27015,
+		SteamId:     "90091830459546624",
+		GameId:      "440",
+		Rules:       map[string]string{"sv_cheats": "0", "mp_timelimit": "30"},
+		PlayerList: []*valve.PlayerInfo{
+			{Index: 0, Name: "Scout", Score: 10, Duration: 12.5},
+		},
+	}
+}
+
+func testError() *ErrorObject {
+	return &ErrorObject{
+		Ip: "10.0.0.2:27015",
+		ErrorDetails: ErrorDetails{
+			Error:     "info: timeout",
+			Phase:     "info",
+			Code:      "timeout",
+			Retryable: true,
+		},
+	}
+}
+
+func writeResults(t *testing.T, writer outputWriter, results ...interface{}) {
+	if err := writer.begin(); err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		var address string
+		switch result := result.(type) {
+		case *ServerObject:
+			address = result.Address
+		case *ErrorObject:
+			address = result.Ip
+		}
+		if err := writer.write(address, result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.end(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTableWriter(t *testing.T) {
+	columns, err := parseColumns("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	writeResults(t, newTableWriter(&out, ',', columns), testServer(), testError())
+
+	expected := "ip,local_ip,protocol,name,map,folder,game,players,max_players,bots,type,os,visibility,vac," +
+		"ping,challenge_ping,theship_mode,theship_witnesses,theship_duration,appid,game_version,port,steamid," +
+		"game_mode,gameid,spectv_port,spectv_name,mod_url,mod_dwlurl,mod_version,mod_size,mod_type,mod_dll," +
+		"rules,player_list,error,phase,code,retryable\n" +
+		"10.0.0.1:27015,,17,\"Test, \"\"quoted\"\"\",ctf_2fort,tf,Team Fortress,12,24,2,dedicated,linux,public,true," +
+		"12.5,,,,,440,1.0.0.0,27015,90091830459546624,,440,,,,,,,,," +
+		"\"{\"\"mp_timelimit\"\":\"\"30\"\",\"\"sv_cheats\"\":\"\"0\"\"}\"," +
+		"\"[{\"\"index\"\":0,\"\"name\"\":\"\"Scout\"\",\"\"score\"\":10,\"\"duration\"\":12.5}]\",,,,\n" +
+		"10.0.0.2:27015,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,info: timeout,info,timeout,true\n"
+	if out.String() != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
+
+func TestTableWriterSeparateTables(t *testing.T) {
+	columns, err := parseColumns("ip,name,players", "rules", "player_list")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out, rules, players bytes.Buffer
+	writer := newTableWriter(&out, '\t', columns)
+	writer.setRulesOutput(&rules)
+	writer.setPlayersOutput(&players)
+	writeResults(t, writer, testServer(), testError())
+
+	expected := "ip\tname\tplayers\n" +
+		"10.0.0.1:27015\t\"Test, \"\"quoted\"\"\"\t12\n" +
+		"10.0.0.2:27015\t\t\n"
+	if out.String() != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+
+	expected = "ip\tname\tvalue\n" +
+		"10.0.0.1:27015\tmp_timelimit\t30\n" +
+		"10.0.0.1:27015\tsv_cheats\t0\n"
+	if rules.String() != expected {
+		t.Errorf("got rules:\n%s\nexpected:\n%s", rules.String(), expected)
+	}
+
+	expected = "ip\tindex\tname\tscore\tduration\ttheship_deaths\ttheship_money\n" +
+		"10.0.0.1:27015\t0\tScout\t10\t12.5\t\t\n"
+	if players.String() != expected {
+		t.Errorf("got players:\n%s\nexpected:\n%s", players.String(), expected)
+	}
+}
+
+func TestParseColumns(t *testing.T) {
+	if _, err := parseColumns("ip,bogus"); err == nil {
+		t.Errorf("expected an error for an unknown column")
+	}
+
+	columns, err := parseColumns("", "rules", "player_list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if containsString(columns, "rules") || containsString(columns, "player_list") || !containsString(columns, "error") {
+		t.Errorf("got columns %v", columns)
+	}
+}
@@ -0,0 +1,175 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	valve "github.com/alliedmodders/blaster/valve"
+)
+
+// Collects target addresses, ignoring duplicates.
+type targetList struct {
+	servers valve.ServerList
+	seen    map[string]bool
+}
+
+func (this *targetList) add(address string) error {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return err
+	}
+	if this.seen[addr.String()] {
+		return nil
+	}
+	this.seen[addr.String()] = true
+	this.servers = append(this.servers, addr)
+	return nil
+}
+
+// Add a server object from blaster's JSON output. In "map" output, the address
+// is the object's key rather than its "ip" field.
+func (this *targetList) addObject(address string, obj map[string]interface{}, onlyErrors bool) error {
+	if onlyErrors && obj["error"] == nil {
+		return nil
+	}
+	if ip, ok := obj["ip"].(string); ok {
+		address = ip
+	}
+	if address == "" {
+		return fmt.Errorf("server object has no \"ip\" field")
+	}
+	return this.add(address)
+}
+
+func (this *targetList) addJson(value interface{}, onlyErrors bool) error {
+	switch value := value.(type) {
+	case []interface{}:
+		// The "list" format.
+		for _, item := range value {
+			obj, ok := item.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("expected a server object, got %v", item)
+			}
+			if err := this.addObject("", obj, onlyErrors); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		// One object from the "lines" format.
+		if _, ok := value["ip"]; ok {
+			return this.addObject("", value, onlyErrors)
+		}
+
+		// The "map" format.
+		keys := []string{}
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			obj, ok := value[key].(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("expected a server object for %s", key)
+			}
+			if err := this.addObject(key, obj, onlyErrors); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("expected a list or object, got %v", value)
+	}
+	return nil
+}
+
+// Read target addresses. The input is either one host:port per line (blank
+// lines and lines starting with # are ignored), or JSON output from an
+// earlier run of blaster in a JSON format. With onlyErrors, only servers that
+// failed in the earlier run are read, which requires JSON input.
+func readTargets(input io.Reader, onlyErrors bool) (valve.ServerList, error) {
+	targets := &targetList{
+		servers: valve.ServerList{},
+		seen:    map[string]bool{},
+	}
+
+	reader := bufio.NewReader(input)
+	for line := 1; ; {
+		r, _, err := reader.ReadRune()
+		if err == io.EOF {
+			return targets.servers, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if r == '\n' {
+			line++
+		}
+		if !unicode.IsSpace(r) {
+			reader.UnreadRune()
+			if r == '[' || r == '{' {
+				break
+			}
+			if onlyErrors {
+				return nil, fmt.Errorf("-onlyerrors requires JSON output from an earlier run, not a list of addresses")
+			}
+			return readTargetLines(reader, targets, line)
+		}
+	}
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var value interface{}
+		if err := decoder.Decode(&value); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if err := targets.addJson(value, onlyErrors); err != nil {
+			return nil, err
+		}
+	}
+	return targets.servers, nil
+}
+
+// Read one address per line, numbering lines from |line|.
+func readTargetLines(reader io.Reader, targets *targetList, line int) (valve.ServerList, error) {
+	scanner := bufio.NewScanner(reader)
+	for ; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := targets.add(text); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return targets.servers, nil
+}
+
+// Read target addresses from a file, or from stdin if the path is "-".
+func readTargetFile(path string, onlyErrors bool) (valve.ServerList, error) {
+	if path == "-" {
+		return readTargets(os.Stdin, onlyErrors)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readTargets(file, onlyErrors)
+}
@@ -0,0 +1,127 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReadTargets(t *testing.T) {
+	cases := []struct {
+		name       string
+		input      string
+		onlyErrors bool
+		expected   []string
+
+		// If set, reading fails with an error containing this.
+		err string
+	}{
+		{
+			name:     "lines",
+			input:    "# servers\n\n10.0.0.1:27015\n  10.0.0.2:27016  \n10.0.0.1:27015\n",
+			expected: []string{"10.0.0.1:27015", "10.0.0.2:27016"},
+		},
+		{
+			name:     "empty",
+			input:    " \n\n",
+			expected: []string{},
+		},
+		{
+			name:  "bad line",
+			input: "\n\n10.0.0.1:27015\nnot-an-address\n",
+			err:   "line 4",
+		},
+		{
+			name:       "lines with onlyerrors",
+			input:      "10.0.0.1:27015\n",
+			onlyErrors: true,
+			err:        "-onlyerrors requires JSON",
+		},
+		{
+			name:     "list",
+			input:    `[{"ip": "10.0.0.1:27015", "name": "a"}, {"ip": "10.0.0.2:27015", "error": "timeout"}]`,
+			expected: []string{"10.0.0.1:27015", "10.0.0.2:27015"},
+		},
+		{
+			name:       "list with onlyerrors",
+			input:      `[{"ip": "10.0.0.1:27015", "name": "a"}, {"ip": "10.0.0.2:27015", "error": "timeout"}]`,
+			onlyErrors: true,
+			expected:   []string{"10.0.0.2:27015"},
+		},
+		{
+			name:     "map",
+			input:    `{"10.0.0.2:27015": {"ip": "10.0.0.2:27015"}, "10.0.0.1:27015": {"error": "timeout"}}`,
+			expected: []string{"10.0.0.1:27015", "10.0.0.2:27015"},
+		},
+		{
+			name:       "map with onlyerrors",
+			input:      `{"10.0.0.2:27015": {"ip": "10.0.0.2:27015"}, "10.0.0.1:27015": {"error": "timeout"}}`,
+			onlyErrors: true,
+			expected:   []string{"10.0.0.1:27015"},
+		},
+		{
+			name:     "json lines",
+			input:    "{\"ip\": \"10.0.0.1:27015\"}\n{\"ip\": \"10.0.0.2:27015\", \"error\": \"timeout\"}\n",
+			expected: []string{"10.0.0.1:27015", "10.0.0.2:27015"},
+		},
+		{
+			name:       "json lines with onlyerrors",
+			input:      "{\"ip\": \"10.0.0.1:27015\"}\n{\"ip\": \"10.0.0.2:27015\", \"error\": \"timeout\"}\n",
+			onlyErrors: true,
+			expected:   []string{"10.0.0.2:27015"},
+		},
+		{
+			name:  "truncated json",
+			input: `[{"ip": "10.0.0.1:27015"}`,
+			err:   "unexpected EOF",
+		},
+		{
+			name:  "invalid json",
+			input: `{"ip": }`,
+			err:   "invalid character",
+		},
+		{
+			name:  "not server objects",
+			input: `[1, 2]`,
+			err:   "expected a server object",
+		},
+		{
+			name:  "missing ip",
+			input: `[{"name": "a"}]`,
+			err:   "no \"ip\" field",
+		},
+		{
+			name:  "bad ip",
+			input: `[{"ip": "10.0.0.1"}]`,
+			err:   "missing port",
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			servers, err := readTargets(strings.NewReader(test.input), test.onlyErrors)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			addrs := []string{}
+			for _, server := range servers {
+				addrs = append(addrs, server.String())
+			}
+			if fmt.Sprint(addrs) != fmt.Sprint(test.expected) {
+				t.Errorf("got %v, expected %v", addrs, test.expected)
+			}
+		})
+	}
+}
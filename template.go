@@ -0,0 +1,193 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// The data for a -template: the fields of a ServerObject, such as .Address and
+// .MapName. If the query failed, only .Address is set, and .Error holds the
+// error details.
+type templateRecord struct {
+	*ServerObject
+	Error *ErrorDetails
+}
+
+// The data for -header and -footer templates. The header is rendered before
+// any servers are queried, so its lists are always empty.
+type templateResults struct {
+	Servers []*templateRecord
+	Errors  []*templateRecord
+}
+
+var kMarkdownEscaper = strings.NewReplacer("|", "\\|", "\r", "", "\n", " ")
+
+var kTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		buf, err := json.Marshal(v)
+		return string(buf), err
+	},
+	"host": func(address string) string {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return address
+		}
+		return host
+	},
+	"port": func(address string) string {
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return ""
+		}
+		return port
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	"replace": func(old, new, str string) string {
+		return strings.ReplaceAll(str, old, new)
+	},
+	"quote":    strconv.Quote,
+	"markdown": kMarkdownEscaper.Replace,
+	"pad": func(width int, str string) string {
+		return fmt.Sprintf("%-*s", width, str)
+	},
+	"add": arithmetic(func(a, b float64) float64 { return a + b }),
+	"sub": arithmetic(func(a, b float64) float64 { return a - b }),
+	"mul": arithmetic(func(a, b float64) float64 { return a * b }),
+	"div": arithmetic(func(a, b float64) float64 { return a / b }),
+}
+
+// Wrap an arithmetic operator so it accepts any numeric field.
+func arithmetic(op func(a, b float64) float64) func(a, b interface{}) (float64, error) {
+	return func(a, b interface{}) (float64, error) {
+		x, err := toFloat(a)
+		if err != nil {
+			return 0, err
+		}
+		y, err := toFloat(b)
+		if err != nil {
+			return 0, err
+		}
+		return op(x, y), nil
+	}
+}
+
+func toFloat(v interface{}) (float64, error) {
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), nil
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+// Parse a template given on the command line. If the text starts with @, the
+// template is read from the named file instead.
+func parseTemplate(name string, text string) (*template.Template, error) {
+	if strings.HasPrefix(text, "@") {
+		buf, err := ioutil.ReadFile(text[1:])
+		if err != nil {
+			return nil, err
+		}
+		text = string(buf)
+	}
+	return template.New(name).Funcs(kTemplateFuncs).Parse(text)
+}
+
+// Writes each result through a text/template, with optional header and
+// footer templates rendered over the whole result set. Output that does not
+// end in a newline gets one, and results that render to nothing are skipped,
+// so templates can use {{if}} to leave out servers.
+type templateWriter struct {
+	out     io.Writer
+	record  *template.Template
+	header  *template.Template
+	footer  *template.Template
+	results templateResults
+}
+
+func newTemplateWriter(out io.Writer, record *template.Template) *templateWriter {
+	return &templateWriter{
+		out:    out,
+		record: record,
+	}
+}
+
+func (this *templateWriter) setHeader(header *template.Template) {
+	this.header = header
+}
+
+func (this *templateWriter) setFooter(footer *template.Template) {
+	this.footer = footer
+}
+
+func (this *templateWriter) render(tmpl *template.Template, data interface{}) error {
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return err
+	}
+	if out.Len() == 0 {
+		return nil
+	}
+	if !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteString("\n")
+	}
+
+	_, err := out.WriteTo(this.out)
+	return err
+}
+
+func (this *templateWriter) begin() error {
+	if this.header == nil {
+		return nil
+	}
+	return this.render(this.header, &templateResults{})
+}
+
+func (this *templateWriter) write(hostAndPort string, obj interface{}) error {
+	var record *templateRecord
+	switch obj := obj.(type) {
+	case *ServerObject:
+		record = &templateRecord{ServerObject: obj}
+	case *ErrorObject:
+		record = &templateRecord{
+			ServerObject: &ServerObject{Address: obj.Ip},
+			Error:        &obj.ErrorDetails,
+		}
+	}
+
+	// Only keep results around if the footer needs them.
+	if this.footer != nil {
+		if record.Error != nil {
+			this.results.Errors = append(this.results.Errors, record)
+		} else {
+			this.results.Servers = append(this.results.Servers, record)
+		}
+	}
+	return this.render(this.record, record)
+}
+
+func (this *templateWriter) end() error {
+	if this.footer == nil {
+		return nil
+	}
+	return this.render(this.footer, &this.results)
+}
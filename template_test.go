@@ -0,0 +1,167 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected string
+
+		// If set, rendering fails with an error containing this.
+		err string
+	}{
+		{text: `{{host .Address}}`, expected: "10.0.0.1"},
+		{text: `{{port .Address}}`, expected: "27015"},
+		{text: `{{host "bogus"}}|{{port "bogus"}}`, expected: "bogus|"},
+		{text: `{{lower .Game}} {{upper .MapName}}`, expected: "team fortress CTF_2FORT"},
+		{text: `{{trim "  x  "}}`, expected: "x"},
+		{text: `{{replace "_" "-" .MapName}}`, expected: "ctf-2fort"},
+		{text: `{{quote .Name}}`, expected: `"Test, \"quoted\""`},
+		{text: `{{markdown "a|b\r\nc"}}`, expected: `a\|b c`},
+		{text: `[{{pad 6 .Folder}}]`, expected: "[tf    ]"},
+		{text: `{{add .Players .Bots}} {{sub .Players .Bots}} {{mul .Players 2}}`, expected: "14 10 24"},
+		{text: `{{div .Players 5}} {{div .Ping 2}}`, expected: "2.4 6.25"},
+		{text: `{{json .Rules}}`, expected: `{"mp_timelimit":"30","sv_cheats":"0"}`},
+		{text: `{{json .PlayerList}}`, expected: `[{"index":0,"name":"Scout","score":10,"duration":12.5}]`},
+		{text: `{{add .Players .Name}}`, err: "is not a number"},
+	}
+
+	for _, test := range cases {
+		tmpl, err := parseTemplate("template", test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		err = newTemplateWriter(&out, tmpl).write("", testServer())
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", test.text, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.text, err)
+			continue
+		}
+		if out.String() != test.expected+"\n" {
+			t.Errorf("%s: got %q, expected %q", test.text, out.String(), test.expected+"\n")
+		}
+	}
+}
+
+func TestTemplateWriter(t *testing.T) {
+	cases := []struct {
+		name     string
+		record   string
+		header   string
+		footer   string
+		expected string
+	}{
+		{
+			name:     "servers and errors",
+			record:   `{{.Address}} {{if .Error}}{{.Error.Code}}{{else}}{{.MapName}}{{end}}`,
+			expected: "10.0.0.1:27015 ctf_2fort\n10.0.0.2:27015 timeout\n",
+		},
+		{
+			name:     "existing newline",
+			record:   "{{.Address}}\n",
+			expected: "10.0.0.1:27015\n10.0.0.2:27015\n",
+		},
+		{
+			name:     "empty records are skipped",
+			record:   `{{if not .Error}}{{.Name}}{{end}}`,
+			expected: "Test, \"quoted\"\n",
+		},
+		{
+			name:     "header and footer",
+			record:   `{{.Address}}`,
+			header:   `{{len .Servers}} servers so far`,
+			footer:   `{{len .Servers}} servers, {{len .Errors}} failed{{range .Errors}} {{.Address}}: {{.Error.Phase}}{{end}}`,
+			expected: "0 servers so far\n10.0.0.1:27015\n10.0.0.2:27015\n1 servers, 1 failed 10.0.0.2:27015: info\n",
+		},
+		{
+			name:     "footer sees servers",
+			record:   ``,
+			footer:   `{{range .Servers}}{{.Name}} on {{.MapName}}{{end}}`,
+			expected: "Test, \"quoted\" on ctf_2fort\n",
+		},
+		{
+			name:     "empty header",
+			record:   `{{.Address}}`,
+			header:   `{{if .Servers}}x{{end}}`,
+			expected: "10.0.0.1:27015\n10.0.0.2:27015\n",
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			record, err := parseTemplate("template", test.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			writer := newTemplateWriter(&out, record)
+			if test.header != "" {
+				header, err := parseTemplate("header", test.header)
+				if err != nil {
+					t.Fatal(err)
+				}
+				writer.setHeader(header)
+			}
+			if test.footer != "" {
+				footer, err := parseTemplate("footer", test.footer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				writer.setFooter(footer)
+			}
+			writeResults(t, writer, testServer(), testError())
+
+			if out.String() != test.expected {
+				t.Errorf("got:\n%s\nexpected:\n%s", out.String(), test.expected)
+			}
+		})
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.tmpl")
+	if err := os.WriteFile(path, []byte("{{.Address}} {{upper .MapName}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := parseTemplate("template", "@"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, testServer()); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "10.0.0.1:27015 CTF_2FORT\n" {
+		t.Errorf("got %q", out.String())
+	}
+
+	if _, err := parseTemplate("template", "@"+path+".missing"); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+	if _, err := parseTemplate("template", "{{.Address"); err == nil {
+		t.Errorf("expected a parse error")
+	}
+	if _, err := parseTemplate("template", "{{bogus .Address}}"); err == nil {
+		t.Errorf("expected an error for an unknown function")
+	}
+}
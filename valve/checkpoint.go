@@ -0,0 +1,102 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrBadCheckpoint = errors.New("checkpoint does not match the query")
+
+const kInitialSeed = "0.0.0.0:0"
+
+// A position within a master query. Every server up to and including Seed
+// has already been passed to the query callback, so the query can be
+// resumed from here after a failure or restart.
+type MasterCheckpoint struct {
+	// Index into the filter list.
+	FilterIndex int `json:"filter_index"`
+
+	// Index into the region list, and the region itself.
+	RegionIndex int    `json:"region_index"`
+	Region      Region `json:"region"`
+
+	// The exact filter string being queried. This differs from the filter
+	// list entry if the query has been sharded.
+	Filter string `json:"filter"`
+
+	// The last address received, which is used as the seed for the next
+	// page of results.
+	Seed string `json:"seed"`
+}
+
+// The callback used to notify of a new checkpoint. This is invoked after each
+// batch of servers has been successfully passed to the query callback.
+type MasterCheckpointCallback func(checkpoint *MasterCheckpoint) error
+
+// Sets a callback to be notified of progress through the query.
+func (this *MasterServerQuerier) SetCheckpointCallback(callback MasterCheckpointCallback) {
+	this.onCheckpoint = callback
+}
+
+// Resume the next call to Query() from a checkpoint. The querier must be set
+// up with the same filters, regions, and partitions as the original query.
+func (this *MasterServerQuerier) Resume(checkpoint *MasterCheckpoint) {
+	this.resume = checkpoint
+}
+
+// Returns the most recent checkpoint, or nil if no servers have been received
+// yet.
+func (this *MasterServerQuerier) Checkpoint() *MasterCheckpoint {
+	if this.current.Seed == "" {
+		return nil
+	}
+	checkpoint := this.current
+	return &checkpoint
+}
+
+func (this *MasterServerQuerier) validateResume(filters []string, regions []Region) error {
+	if this.resume == nil {
+		return nil
+	}
+
+	resume := this.resume
+	if resume.FilterIndex < 0 || resume.FilterIndex >= len(filters) {
+		return ErrBadCheckpoint
+	}
+	if resume.RegionIndex < 0 || resume.RegionIndex >= len(regions) {
+		return ErrBadCheckpoint
+	}
+	if regions[resume.RegionIndex] != resume.Region {
+		return ErrBadCheckpoint
+	}
+	if !strings.HasPrefix(resume.Filter, filters[resume.FilterIndex]) {
+		return ErrBadCheckpoint
+	}
+	return nil
+}
+
+// Returns true if the query at the given position was completed before the
+// checkpoint being resumed from.
+func (this *MasterServerQuerier) skipForResume(filterIndex int, regionIndex int) bool {
+	if this.resume == nil {
+		return false
+	}
+	if filterIndex != this.resume.FilterIndex {
+		return filterIndex < this.resume.FilterIndex
+	}
+	return regionIndex < this.resume.RegionIndex
+}
+
+func (this *MasterServerQuerier) recordCheckpoint(filter string, seed string) error {
+	this.current.Filter = filter
+	this.current.Seed = seed
+	if this.onCheckpoint == nil {
+		return nil
+	}
+	return this.onCheckpoint(this.Checkpoint())
+}
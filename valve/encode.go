@@ -0,0 +1,271 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"sort"
+
+	"github.com/alliedmodders/blaster/valve/internal/bzip2"
+)
+
+// The largest payload Source servers put in a single packet before splitting
+// a reply.
+const kDefaultSplitSize = 1248
+
+var ErrReplyTooLarge = errors.New("reply needs too many split packets")
+
+func newReply(kind uint8) *PacketBuilder {
+	packet := &PacketBuilder{}
+	packet.WriteBytes([]byte{0xff, 0xff, 0xff, 0xff, kind})
+	return packet
+}
+
+func serverTypeByte(serverType ServerType) byte {
+	switch serverType {
+	case ServerType_Dedicated:
+		return 'd'
+	case ServerType_Listen:
+		return 'l'
+	case ServerType_HLTV:
+		return 'p'
+	}
+	return 0
+}
+
+func serverOSByte(serverOS ServerOS) byte {
+	switch serverOS {
+	case ServerOS_Linux:
+		return 'l'
+	case ServerOS_Windows:
+		return 'w'
+	case ServerOS_Mac:
+		return 'm'
+	}
+	return 0
+}
+
+// Encode an A2S_INFO reply in the format given by info.InfoVersion.
+func EncodeInfoReply(info *ServerInfo) []byte {
+	if info.InfoVersion == S2A_INFO_GOLDSRC {
+		return EncodeGoldSrcInfoReply(info)
+	}
+	return EncodeSourceInfoReply(info)
+}
+
+// Encode an S2A_INFO_SOURCE reply. Extra data fields are only sent if they
+// are set.
+func EncodeSourceInfoReply(info *ServerInfo) []byte {
+	ext := info.Ext
+	if ext == nil {
+		ext = &ExtendedInfo{}
+	}
+
+	packet := newReply(S2A_INFO_SOURCE)
+	packet.WriteByte(info.Protocol)
+	packet.WriteCString(info.Name)
+	packet.WriteCString(info.MapName)
+	packet.WriteCString(info.Folder)
+	packet.WriteCString(info.Game)
+	binary.Write(packet, binary.LittleEndian, uint16(ext.AppId))
+	packet.WriteByte(info.Players)
+	packet.WriteByte(info.MaxPlayers)
+	packet.WriteByte(info.Bots)
+	packet.WriteByte(serverTypeByte(info.Type))
+	packet.WriteByte(serverOSByte(info.OS))
+	packet.WriteByte(info.Visibility)
+	packet.WriteByte(info.Vac)
+	if info.TheShip != nil {
+		packet.WriteByte(info.TheShip.Mode)
+		packet.WriteByte(info.TheShip.Witnesses)
+		packet.WriteByte(info.TheShip.Duration)
+	}
+	packet.WriteCString(ext.GameVersion)
+
+	edf := uint8(0)
+	if ext.Port != 0 {
+		edf |= 0x80
+	}
+	if ext.SteamId != 0 {
+		edf |= 0x10
+	}
+	if info.SpecTv != nil {
+		edf |= 0x40
+	}
+	if ext.GameModeDescription != "" {
+		edf |= 0x20
+	}
+	if ext.GameId != 0 {
+		edf |= 0x01
+	}
+	if edf == 0 {
+		return packet.Bytes()
+	}
+
+	packet.WriteByte(edf)
+	if (edf & 0x80) != 0 {
+		binary.Write(packet, binary.LittleEndian, ext.Port)
+	}
+	if (edf & 0x10) != 0 {
+		binary.Write(packet, binary.LittleEndian, ext.SteamId)
+	}
+	if (edf & 0x40) != 0 {
+		binary.Write(packet, binary.LittleEndian, info.SpecTv.Port)
+		packet.WriteCString(info.SpecTv.Name)
+	}
+	if (edf & 0x20) != 0 {
+		packet.WriteCString(ext.GameModeDescription)
+	}
+	if (edf & 0x01) != 0 {
+		binary.Write(packet, binary.LittleEndian, ext.GameId)
+	}
+	return packet.Bytes()
+}
+
+// Encode an S2A_INFO_GOLDSRC reply.
+func EncodeGoldSrcInfoReply(info *ServerInfo) []byte {
+	packet := newReply(S2A_INFO_GOLDSRC)
+	packet.WriteCString(info.Address)
+	packet.WriteCString(info.Name)
+	packet.WriteCString(info.MapName)
+	packet.WriteCString(info.Folder)
+	packet.WriteCString(info.Game)
+	packet.WriteByte(info.Players)
+	packet.WriteByte(info.MaxPlayers)
+	packet.WriteByte(info.Protocol)
+	packet.WriteByte(serverTypeByte(info.Type))
+	packet.WriteByte(serverOSByte(info.OS))
+	packet.WriteByte(info.Visibility)
+	if info.Mod != nil {
+		packet.WriteByte(1)
+		packet.WriteCString(info.Mod.Url)
+		packet.WriteCString(info.Mod.DwlUrl)
+		packet.WriteByte(0)
+		binary.Write(packet, binary.LittleEndian, info.Mod.Version)
+		binary.Write(packet, binary.LittleEndian, info.Mod.Size)
+		packet.WriteByte(info.Mod.Type)
+		packet.WriteByte(info.Mod.Dll)
+	} else {
+		packet.WriteByte(0)
+	}
+	packet.WriteByte(info.Vac)
+	packet.WriteByte(info.Bots)
+	return packet.Bytes()
+}
+
+// Encode an S2A_RULES reply. Rules are sent sorted by name.
+func EncodeRulesReply(rules map[string]string) []byte {
+	keys := []string{}
+	for key := range rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	packet := newReply(S2A_RULES)
+	binary.Write(packet, binary.LittleEndian, uint16(len(keys)))
+	for _, key := range keys {
+		packet.WriteCString(key)
+		packet.WriteCString(rules[key])
+	}
+	return packet.Bytes()
+}
+
+// Encode an S2A_PLAYER reply. If theShip is true, deaths and money are
+// appended for each player, as The Ship does.
+func EncodePlayersReply(players []*PlayerInfo, theShip bool) []byte {
+	packet := newReply(S2A_PLAYER)
+	packet.WriteByte(byte(len(players)))
+	for _, player := range players {
+		packet.WriteByte(player.Index)
+		packet.WriteCString(player.Name)
+		binary.Write(packet, binary.LittleEndian, player.Score)
+		binary.Write(packet, binary.LittleEndian, math.Float32bits(player.Duration))
+	}
+	if theShip {
+		for _, player := range players {
+			ship := player.TheShip
+			if ship == nil {
+				ship = &TheShipPlayerInfo{}
+			}
+			binary.Write(packet, binary.LittleEndian, ship.Deaths)
+			binary.Write(packet, binary.LittleEndian, ship.Money)
+		}
+	}
+	return packet.Bytes()
+}
+
+// Encode an S2C_CHALLENGE reply.
+func EncodeChallengeReply(challenge uint32) []byte {
+	packet := newReply(S2C_CHALLENGE)
+	binary.Write(packet, binary.LittleEndian, challenge)
+	return packet.Bytes()
+}
+
+// Split a reply into packets of at most splitSize bytes of payload, using the
+// split header format of the engine described by info. Each reply must have a
+// different id. Compression is only used by Source servers that are not
+// pre-Orange Box. Replies that fit in one packet are returned unchanged.
+func SplitReply(info *ServerInfo, id uint32, reply []byte, splitSize int, compress bool) ([][]byte, error) {
+	if splitSize <= 0 {
+		splitSize = kDefaultSplitSize
+	}
+	if len(reply) <= splitSize {
+		return [][]byte{reply}, nil
+	}
+
+	engine := info.GameEngine()
+	preOrangeBox := engine == SOURCE && info.IsPreOrangeBox()
+
+	// The top bit of the id marks a compressed reply.
+	id &= 0x7fffffff
+	payload := reply
+	if compress && engine == SOURCE && !preOrangeBox {
+		id |= 0x80000000
+
+		compressed := PacketBuilder{}
+		binary.Write(&compressed, binary.LittleEndian, uint32(len(reply)))
+		binary.Write(&compressed, binary.LittleEndian, crc32.ChecksumIEEE(reply))
+		compressed.WriteBytes(bzip2.Compress(reply))
+		payload = compressed.Bytes()
+	}
+
+	var chunks [][]byte
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > splitSize {
+			n = splitSize
+		}
+		chunks = append(chunks, payload[:n])
+		payload = payload[n:]
+	}
+
+	// GoldSrc packs the packet number and count into one byte.
+	if (engine == GOLDSRC && len(chunks) > 15) || len(chunks) > 255 {
+		return nil, ErrReplyTooLarge
+	}
+
+	packets := [][]byte{}
+	for i, chunk := range chunks {
+		packet := PacketBuilder{}
+		binary.Write(&packet, binary.LittleEndian, int32(-2))
+		binary.Write(&packet, binary.LittleEndian, id)
+		if engine == GOLDSRC {
+			packet.WriteByte(byte(i<<4) | byte(len(chunks)))
+		} else {
+			packet.WriteByte(byte(len(chunks)))
+			packet.WriteByte(byte(i))
+			if !preOrangeBox {
+				binary.Write(&packet, binary.LittleEndian, uint16(splitSize))
+			}
+		}
+		packet.WriteBytes(chunk)
+		packets = append(packets, packet.Bytes())
+	}
+	return packets, nil
+}
@@ -0,0 +1,143 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"compress/bzip2"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// The part of a server query that failed.
+type QueryPhase string
+
+const (
+	Phase_Dial        QueryPhase = "dial"
+	Phase_Info        QueryPhase = "info"
+	Phase_Challenge   QueryPhase = "challenge"
+	Phase_Rules       QueryPhase = "rules"
+	Phase_Players     QueryPhase = "players"
+	Phase_MultiPacket QueryPhase = "multipacket"
+	Phase_Decompress  QueryPhase = "decompress"
+)
+
+// A QueryError is returned by ServerQuerier when a query fails. It records
+// where the query failed, a stable code describing why, and whether the same
+// query might succeed if tried again.
+type QueryError struct {
+	Phase QueryPhase
+
+	// A short, stable identifier such as "timeout" or "bad_packet_header",
+	// suitable for aggregating failures.
+	Code string
+
+	// Whether the failure might be transient, such as a lost packet.
+	Retryable bool
+
+	// The underlying error.
+	Err error
+}
+
+func (this *QueryError) Error() string {
+	return fmt.Sprintf("%s: %s", this.Phase, this.Err.Error())
+}
+
+func (this *QueryError) Unwrap() error {
+	return this.Err
+}
+
+type errorCode struct {
+	code      string
+	retryable bool
+}
+
+var kErrorCodes = map[error]errorCode{
+	ErrBadPacketHeader:        {"bad_packet_header", false},
+	ErrMistakenReply:          {"mistaken_reply", true},
+	ErrUnknownInfoVersion:     {"unknown_info_version", false},
+	ErrImmediateRulesReply:    {"immediate_rules_reply", false},
+	ErrBadChallengeResponse:   {"bad_challenge_response", false},
+	ErrUnknownGameEngine:      {"unknown_game_engine", false},
+	ErrDuplicatePacket:        {"duplicate_packet", true},
+	ErrBadPacketNumber:        {"bad_packet_number", true},
+	ErrConfusedChallengeReply: {"confused_challenge_reply", true},
+	ErrBadRulesReply:          {"bad_rules_reply", false},
+	ErrBadPlayersReply:        {"bad_players_reply", false},
+	ErrWrongBz2Size:           {"bad_decompressed_size", false},
+	ErrWrongBz2Checksum:       {"bad_checksum", true},
+	ErrOutOfBounds:            {"truncated_packet", false},
+	ErrAddressInUse:           {"address_in_use", true},
+	ErrSocketClosed:           {"socket_closed", false},
+}
+
+// A panic recovered by Try.
+type panicError struct {
+	err error
+}
+
+func (this *panicError) Error() string {
+	return this.err.Error()
+}
+
+func (this *panicError) Unwrap() error {
+	return this.err
+}
+
+func classifyError(err error) errorCode {
+	for known, code := range kErrorCodes {
+		if errors.Is(err, known) {
+			return code
+		}
+	}
+
+	var panicErr *panicError
+	var dnsErr *net.DNSError
+	var bz2Err bzip2.StructuralError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &panicErr):
+		return errorCode{"panic", false}
+	case errors.Is(err, context.Canceled):
+		return errorCode{"canceled", false}
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorCode{"deadline_exceeded", false}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorCode{"connection_refused", false}
+	case errors.As(err, &dnsErr):
+		return errorCode{"resolve_failed", dnsErr.IsTemporary || dnsErr.IsTimeout}
+	case errors.As(err, &bz2Err):
+		return errorCode{"bad_compressed_data", false}
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errorCode{"timeout", true}
+	case errors.As(err, &netErr):
+		return errorCode{"network", false}
+	}
+	return errorCode{"unknown", false}
+}
+
+// Wrap an error in a QueryError for the given phase. Errors that are already
+// QueryErrors keep their original phase.
+func newQueryError(phase QueryPhase, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		return err
+	}
+
+	code := classifyError(err)
+	return &QueryError{
+		Phase:     phase,
+		Code:      code.code,
+		Retryable: code.retryable,
+		Err:       err,
+	}
+}
@@ -0,0 +1,69 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestQueryErrorCodes(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}
+	refused := &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.ECONNREFUSED)}
+	panicked := Try(func() error {
+		var info *ServerInfo
+		return fmt.Errorf("%d", info.Players)
+	})
+
+	cases := []struct {
+		err       error
+		code      string
+		retryable bool
+	}{
+		{ErrBadPacketHeader, "bad_packet_header", false},
+		{fmt.Errorf("wrapped: %w", ErrDuplicatePacket), "duplicate_packet", true},
+		{ErrOutOfBounds, "truncated_packet", false},
+		{timeout, "timeout", true},
+		{refused, "connection_refused", false},
+		{context.Canceled, "canceled", false},
+		{panicked, "panic", false},
+		{errors.New("something else"), "unknown", false},
+	}
+
+	for _, test := range cases {
+		err := newQueryError(Phase_Rules, test.err)
+		var queryErr *QueryError
+		if !errors.As(err, &queryErr) {
+			t.Fatalf("%v: not a QueryError", test.err)
+		}
+		if queryErr.Phase != Phase_Rules || queryErr.Code != test.code || queryErr.Retryable != test.retryable {
+			t.Errorf("%v: got %s/%s/%v, expected rules/%s/%v", test.err,
+				queryErr.Phase, queryErr.Code, queryErr.Retryable, test.code, test.retryable)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%v: does not unwrap to the original error", test.err)
+		}
+	}
+}
+
+func TestQueryErrorKeepsPhase(t *testing.T) {
+	inner := newQueryError(Phase_Decompress, ErrWrongBz2Checksum)
+	outer := newQueryError(Phase_Rules, inner)
+	if outer != inner {
+		t.Errorf("expected the original error, got %v", outer)
+	}
+	if outer.Error() != "decompress: bad bz2 checksum" {
+		t.Errorf("unexpected message: %s", outer.Error())
+	}
+	if newQueryError(Phase_Info, nil) != nil {
+		t.Errorf("expected nil for no error")
+	}
+}
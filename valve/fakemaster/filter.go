@@ -0,0 +1,220 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package fakemaster
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alliedmodders/blaster/valve"
+)
+
+var ErrMalformedFilter = errors.New("malformed master filter")
+
+// A parsed master filter condition.
+type condition interface {
+	matches(entry *Entry) bool
+}
+
+type pairCondition struct {
+	key   string
+	value string
+}
+
+type groupCondition struct {
+	op         string
+	conditions []condition
+}
+
+// Parse a filter string in wire format, such as "\appid\440\empty\1". The
+// conditions at the top level must all match.
+func parseFilter(filter string) ([]condition, error) {
+	if filter == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(filter, "\\") {
+		return nil, ErrMalformedFilter
+	}
+
+	tokens := strings.Split(filter[1:], "\\")
+	if len(tokens)%2 != 0 {
+		return nil, ErrMalformedFilter
+	}
+
+	conditions := []condition{}
+	for len(tokens) > 0 {
+		cond, rest, err := parseCondition(tokens)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, cond)
+		tokens = rest
+	}
+	return conditions, nil
+}
+
+// Parse one condition, returning it and the remaining tokens. Groups consume
+// the number of conditions given in their header, where a nested group counts
+// as one condition.
+func parseCondition(tokens []string) (condition, []string, error) {
+	key, value, rest := strings.ToLower(tokens[0]), tokens[1], tokens[2:]
+	switch key {
+	case "or", "and", "nor", "nand":
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, nil, ErrMalformedFilter
+		}
+
+		group := &groupCondition{op: key}
+		for i := 0; i < count; i++ {
+			if len(rest) == 0 {
+				return nil, nil, ErrMalformedFilter
+			}
+
+			var cond condition
+			cond, rest, err = parseCondition(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			group.conditions = append(group.conditions, cond)
+		}
+		return group, rest, nil
+	}
+	return &pairCondition{key: key, value: value}, rest, nil
+}
+
+func (this *groupCondition) matches(entry *Entry) bool {
+	matched := 0
+	for _, cond := range this.conditions {
+		if cond.matches(entry) {
+			matched++
+		}
+	}
+
+	switch this.op {
+	case "or":
+		return matched > 0
+	case "and":
+		return matched == len(this.conditions)
+	case "nor":
+		return matched == 0
+	case "nand":
+		return matched < len(this.conditions)
+	}
+	return false
+}
+
+// Flags with a value of "0" are ignored, and unknown keys match everything,
+// which is how the Steam master appears to treat them.
+func (this *pairCondition) matches(entry *Entry) bool {
+	switch this.key {
+	case "dedicated", "secure", "linux", "empty", "full", "proxy", "noplayers", "white":
+		if this.value == "0" {
+			return true
+		}
+	}
+
+	info := entry.Info
+	if info == nil {
+		info = &valve.ServerInfo{}
+	}
+	ext := info.Ext
+	if ext == nil {
+		ext = &valve.ExtendedInfo{}
+	}
+
+	switch this.key {
+	case "dedicated":
+		return info.Type == valve.ServerType_Dedicated
+	case "secure":
+		return info.Vac == 1
+	case "linux":
+		return info.OS == valve.ServerOS_Linux
+	case "empty":
+		return info.Players > 0
+	case "full":
+		return info.Players < info.MaxPlayers
+	case "proxy":
+		return info.Type == valve.ServerType_HLTV
+	case "noplayers":
+		return info.Players == 0
+	case "white":
+		return entry.Whitelisted
+	case "gamedir":
+		return strings.EqualFold(info.Folder, this.value)
+	case "map":
+		return strings.EqualFold(info.MapName, this.value)
+	case "appid":
+		return this.value == strconv.FormatUint(uint64(ext.AppId), 10)
+	case "napp":
+		return this.value != strconv.FormatUint(uint64(ext.AppId), 10)
+	case "gametype":
+		return hasTags(splitTags(ext.GameModeDescription), splitTags(this.value), true)
+	case "gamedata":
+		return hasTags(entry.GameData, splitTags(this.value), true)
+	case "gamedataor":
+		return hasTags(entry.GameData, splitTags(this.value), false)
+	case "name_match":
+		return wildcardMatch(this.value, info.Name)
+	case "version_match":
+		return wildcardMatch(this.value, ext.GameVersion)
+	case "gameaddr":
+		return matchAddress(this.value, entry.Addr)
+	}
+	return true
+}
+
+func splitTags(tags string) []string {
+	if tags == "" {
+		return nil
+	}
+	return strings.Split(tags, ",")
+}
+
+// Returns whether |have| contains all (or any) of |want|.
+func hasTags(have []string, want []string, all bool) bool {
+	for _, tag := range want {
+		found := false
+		for _, other := range have {
+			if strings.EqualFold(tag, other) {
+				found = true
+				break
+			}
+		}
+		if found && !all {
+			return true
+		}
+		if !found && all {
+			return false
+		}
+	}
+	return all
+}
+
+// Match a pattern where "*" matches any sequence of characters.
+func wildcardMatch(pattern string, str string) bool {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	re, err := regexp.Compile("(?i)^" + strings.Join(parts, ".*") + "$")
+	return err == nil && re.MatchString(str)
+}
+
+// Match an "ip" or "ip:port" filter against a server address.
+func matchAddress(filter string, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if strings.Contains(filter, ":") {
+		return filter == addr
+	}
+	return filter == host
+}
@@ -0,0 +1,87 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package fakemaster
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alliedmodders/blaster/valve"
+)
+
+// Parse a server list. Each line is an address, optionally followed by a
+// region name. Blank lines and lines starting with # are ignored.
+func ParseServerList(r io.Reader) ([]*Entry, error) {
+	servers := []*Entry{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		entry := &Entry{
+			Addr:   fields[0],
+			Region: valve.Region_All,
+		}
+		if len(fields) > 1 {
+			region, err := valve.ParseRegion(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err.Error())
+			}
+			entry.Region = region
+		}
+		servers = append(servers, entry)
+	}
+	return servers, scanner.Err()
+}
+
+// Read a server list file. If timeout is non-zero, each server is also
+// queried for the information used to evaluate filters; servers that do not
+// reply are still listed, but only match filters that do not depend on
+// server information.
+func LoadServerList(path string, timeout time.Duration) ([]*Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	servers, err := ParseServerList(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if timeout > 0 {
+		queryServers(servers, timeout)
+	}
+	return servers, nil
+}
+
+func queryServers(servers []*Entry, timeout time.Duration) {
+	wg := sync.WaitGroup{}
+	for _, entry := range servers {
+		wg.Add(1)
+		go (func(entry *Entry) {
+			defer wg.Done()
+
+			query, err := valve.NewServerQuerier(entry.Addr, timeout)
+			if err != nil {
+				return
+			}
+			defer query.Close()
+
+			if info, err := query.QueryInfo(); err == nil {
+				entry.Info = info
+			}
+		})(entry)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,143 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package fakemaster
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alliedmodders/blaster/valve"
+)
+
+func TestParseServerList(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+
+		// If set, parsing fails with an error containing this.
+		err string
+	}{
+		{
+			name:     "addresses",
+			input:    "10.0.0.1:27015\n10.0.0.2:27016\n",
+			expected: "[10.0.0.1:27015/all 10.0.0.2:27016/all]",
+		},
+		{
+			name:     "regions",
+			input:    "10.0.0.1:27015 europe\n10.0.0.2:27015\tasia\n10.0.0.3:27015 all\n",
+			expected: "[10.0.0.1:27015/europe 10.0.0.2:27015/asia 10.0.0.3:27015/all]",
+		},
+		{
+			name:     "comments and blank lines",
+			input:    "# servers\n\n  \n10.0.0.1:27015 us-east\n#10.0.0.2:27015\n",
+			expected: "[10.0.0.1:27015/us-east]",
+		},
+		{
+			name:     "empty",
+			input:    "",
+			expected: "[]",
+		},
+		{
+			name:  "unknown region",
+			input: "10.0.0.1:27015\n10.0.0.2:27015 mars\n",
+			err:   "line 2: unknown region: mars",
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			servers, err := ParseServerList(strings.NewReader(test.input))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries := []string{}
+			for _, entry := range servers {
+				entries = append(entries, entry.Addr+"/"+entry.Region.String())
+			}
+			if fmt.Sprint(entries) != test.expected {
+				t.Errorf("got %v, expected %s", entries, test.expected)
+			}
+		})
+	}
+}
+
+func TestLoadServerList(t *testing.T) {
+	responder, err := valve.NewResponder(sourceInfo(valve.App_TF2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go responder.Serve(conn)
+
+	path := filepath.Join(t.TempDir(), "servers.txt")
+	writeList := func(list string) {
+		if err := os.WriteFile(path, []byte(list), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without a timeout, servers are listed without being queried.
+	writeList(conn.LocalAddr().String() + "\n")
+	servers, err := LoadServerList(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0].Info != nil {
+		t.Fatalf("expected one server with no info, got %+v", servers)
+	}
+
+	// Queried servers can be matched by their info.
+	servers, err = LoadServerList(path, time.Millisecond*500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master := NewMaster(servers)
+	query := startMaster(t, master)
+	query.AddCommonFilter(valve.FilterMap("de_dust2"))
+	if addrs, err := queryAll(query); err != nil || fmt.Sprint(addrs) != "["+conn.LocalAddr().String()+"]" {
+		t.Errorf("got %v, %v", addrs, err)
+	}
+
+	// Re-reading the list picks up edits. Servers that do not reply are still
+	// listed, but not matched by filters on their info.
+	writeList(conn.LocalAddr().String() + "\n10.0.0.1:27015 europe\n")
+	servers, err = LoadServerList(path, time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master.SetServers(servers)
+	if addrs, err := queryAll(query); err != nil || fmt.Sprint(addrs) != "["+conn.LocalAddr().String()+"]" {
+		t.Errorf("got %v, %v", addrs, err)
+	}
+	query.ClearFilters()
+	query.SetRegions(valve.Region_Europe)
+	if addrs, err := queryAll(query); err != nil || fmt.Sprint(addrs) != "[10.0.0.1:27015]" {
+		t.Errorf("got %v, %v", addrs, err)
+	}
+
+	// A bad list is reported with its path and line.
+	writeList("10.0.0.1:27015 mars\n")
+	if _, err := LoadServerList(path, 0); err == nil || !strings.Contains(err.Error(), path+": line 1") {
+		t.Errorf("expected an error for the bad region, got %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+
+// Package fakemaster emulates the Valve master server, for private server
+// lists and for testing code that queries the master.
+package fakemaster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alliedmodders/blaster/valve"
+)
+
+// The number of servers the Steam master sends in each reply.
+const kDefaultPageSize = 231
+
+var kMasterReplyHeader = []byte{0xff, 0xff, 0xff, 0xff, 0x66, 0x0a}
+
+// A server listed by a Master.
+type Entry struct {
+	// An IPv4 address and port.
+	Addr string
+
+	// The region the server is in. Servers in Region_All are only returned
+	// for queries of every region, as with the Steam master.
+	Region valve.Region
+
+	// Information used to evaluate filters. If nil, only filters that do not
+	// depend on server information will match.
+	Info *valve.ServerInfo
+
+	// Hidden tags, for the gamedata and gamedataor filters.
+	GameData []string
+
+	Whitelisted bool
+}
+
+// A Master is a local UDP server that answers Master Server Query
+// Protocol requests for a fixed list of servers. Configure it before calling
+// Start(); only the server list may be changed while it is running, using
+// SetServers().
+type Master struct {
+	// Number of servers in each reply. Defaults to the Steam master's page
+	// size.
+	PageSize int
+
+	// If non-zero, requests beyond this many per minute from a single address
+	// are ignored, as the Steam master does.
+	RateLimit int
+
+	// The probability that a request is ignored, to simulate packet loss.
+	DropRate float64
+
+	// If non-zero, requests for pages starting beyond this many servers into
+	// a result set are ignored, as the Steam master stops replying partway
+	// through very large result sets.
+	MaxResults int
+
+	conn     net.PacketConn
+	lock     sync.Mutex
+	servers  []*Entry
+	history  map[string][]time.Time
+	requests int
+	done     chan bool
+}
+
+// Create a new fake master server, which is not yet listening.
+func NewMaster(servers []*Entry) *Master {
+	return &Master{
+		servers: servers,
+		history: map[string][]time.Time{},
+	}
+}
+
+// Start listening on a random local port.
+func (this *Master) Start() error {
+	return this.Listen("127.0.0.1:0")
+}
+
+// Start listening on the given address.
+func (this *Master) Listen(address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+
+	this.conn = conn
+	this.done = make(chan bool)
+	go this.serve()
+	return nil
+}
+
+// The address the master is listening on.
+func (this *Master) Addr() string {
+	return this.conn.LocalAddr().String()
+}
+
+// Replace the server list. Queries that are paging through the old list will
+// continue from their seed address in the new list.
+func (this *Master) SetServers(servers []*Entry) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.servers = servers
+}
+
+// Number of packets received so far, including ignored ones.
+func (this *Master) Requests() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.requests
+}
+
+// Stop the master and wait for it to exit.
+func (this *Master) Close() {
+	this.conn.Close()
+	<-this.done
+}
+
+func (this *Master) serve() {
+	defer close(this.done)
+
+	buffer := make([]byte, 1400)
+	for {
+		n, addr, err := this.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+
+		this.lock.Lock()
+		this.requests++
+		var reply []byte
+		if this.allowRequest(addr.String()) {
+			reply = this.handle(buffer[:n])
+		}
+		this.lock.Unlock()
+
+		if reply != nil {
+			this.conn.WriteTo(reply, addr)
+		}
+	}
+}
+
+// Apply packet loss and rate limiting to a request.
+func (this *Master) allowRequest(client string) bool {
+	if this.DropRate > 0 && rand.Float64() < this.DropRate {
+		return false
+	}
+	if this.RateLimit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	recent := []time.Time{}
+	for _, when := range this.history[client] {
+		if now.Sub(when) < time.Minute {
+			recent = append(recent, when)
+		}
+	}
+	if len(recent) >= this.RateLimit {
+		this.history[client] = recent
+		return false
+	}
+	this.history[client] = append(recent, now)
+	return true
+}
+
+// Returns the reply to a request, or nil to ignore it.
+func (this *Master) handle(request []byte) []byte {
+	reader := valve.NewPacketReader(request)
+	if reader.ReadUint8() != 0x31 {
+		return nil
+	}
+	region := valve.Region(reader.ReadUint8())
+	seed := reader.ReadString()
+	filter := reader.ReadString()
+	if reader.Err() != nil {
+		return nil
+	}
+
+	seedAddr, err := net.ResolveUDPAddr("udp4", seed)
+	if err != nil {
+		return nil
+	}
+	conditions, err := parseFilter(filter)
+	if err != nil {
+		return nil
+	}
+
+	matches := this.match(region, conditions)
+
+	// Send the servers after the seed address.
+	start := sort.Search(len(matches), func(i int) bool {
+		return compareAddr(matches[i], seedAddr) > 0
+	})
+	if this.MaxResults > 0 && start >= this.MaxResults {
+		return nil
+	}
+	pageSize := this.PageSize
+	if pageSize <= 0 {
+		pageSize = kDefaultPageSize
+	}
+
+	packet := &bytes.Buffer{}
+	packet.Write(kMasterReplyHeader)
+	for i := start; i < len(matches) && i < start+pageSize; i++ {
+		writeAddr(packet, matches[i])
+	}
+	if len(matches)-start < pageSize {
+		writeAddr(packet, &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	}
+	return packet.Bytes()
+}
+
+// Returns every server matching a query, sorted by address.
+func (this *Master) match(region valve.Region, conditions []condition) []*net.UDPAddr {
+	collapse := false
+	for _, cond := range conditions {
+		if pair, ok := cond.(*pairCondition); ok && pair.key == "collapse_addr_hash" && pair.value != "0" {
+			collapse = true
+		}
+	}
+
+	matches := []*net.UDPAddr{}
+	for _, entry := range this.servers {
+		if region != valve.Region_All && region != entry.Region {
+			continue
+		}
+
+		addr, err := net.ResolveUDPAddr("udp4", entry.Addr)
+		if err != nil || addr.IP.To4() == nil {
+			continue
+		}
+
+		matched := true
+		for _, cond := range conditions {
+			if !cond.matches(entry) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, addr)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return compareAddr(matches[i], matches[j]) < 0
+	})
+
+	if collapse {
+		unique := []*net.UDPAddr{}
+		for _, addr := range matches {
+			if len(unique) == 0 || !unique[len(unique)-1].IP.Equal(addr.IP) {
+				unique = append(unique, addr)
+			}
+		}
+		matches = unique
+	}
+	return matches
+}
+
+func compareAddr(a *net.UDPAddr, b *net.UDPAddr) int {
+	if c := bytes.Compare(a.IP.To4(), b.IP.To4()); c != 0 {
+		return c
+	}
+	return a.Port - b.Port
+}
+
+func writeAddr(packet *bytes.Buffer, addr *net.UDPAddr) {
+	packet.Write(addr.IP.To4())
+	binary.Write(packet, binary.BigEndian, uint16(addr.Port))
+}
@@ -0,0 +1,350 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package fakemaster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alliedmodders/blaster/valve"
+)
+
+func sourceInfo(appId valve.AppId) *valve.ServerInfo {
+	return &valve.ServerInfo{
+		InfoVersion: valve.S2A_INFO_SOURCE,
+		Protocol:    17,
+		Name:        "Fake Source Server",
+		MapName:     "de_dust2",
+		Folder:      "cstrike",
+		Game:        "Counter-Strike: Source",
+		Players:     3,
+		MaxPlayers:  24,
+		Bots:        1,
+		Type:        valve.ServerType_Dedicated,
+		OS:          valve.ServerOS_Linux,
+		Vac:         1,
+		SpecTv: &valve.SpecTvInfo{
+			Port: 27020,
+			Name: "SourceTV",
+		},
+		Ext: &valve.ExtendedInfo{
+			AppId:               appId,
+			GameVersion:         "1.0.0.70",
+			Port:                27015,
+			SteamId:             90091830459546624,
+			GameModeDescription: "alltalk",
+			GameId:              uint64(appId),
+		},
+	}
+}
+
+func masterEntry(addr string, appId valve.AppId, serverType valve.ServerType, tags string) *Entry {
+	info := sourceInfo(appId)
+	info.Type = serverType
+	info.Ext.GameModeDescription = tags
+	return &Entry{Addr: addr, Region: valve.Region_All, Info: info}
+}
+
+func startMaster(t *testing.T, master *Master) *valve.MasterServerQuerier {
+	if err := master.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(master.Close)
+	return newMasterQuerier(t, master)
+}
+
+func newMasterQuerier(t *testing.T, master *Master) *valve.MasterServerQuerier {
+	query, err := valve.NewMasterServerQuerier(master.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	query.SetRateLimit(0)
+	query.SetTimeout(time.Millisecond * 200)
+	t.Cleanup(query.Close)
+	return query
+}
+
+func queryAll(query *valve.MasterServerQuerier) ([]string, error) {
+	addrs := []string{}
+	err := query.Query(func(servers valve.ServerList) error {
+		for _, server := range servers {
+			addrs = append(addrs, server.String())
+		}
+		return nil
+	})
+	sort.Strings(addrs)
+	return addrs, err
+}
+
+func TestMasterPaging(t *testing.T) {
+	servers := []*Entry{}
+	expected := []string{}
+	for i := 0; i < 500; i++ {
+		addr := fmt.Sprintf("10.0.%d.%d:27015", i/200, i%200)
+		servers = append(servers, masterEntry(addr, valve.App_TF2, valve.ServerType_Dedicated, ""))
+		expected = append(expected, addr)
+	}
+	sort.Strings(expected)
+
+	master := NewMaster(servers)
+	master.PageSize = 100
+	query := startMaster(t, master)
+
+	addrs, err := queryAll(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(addrs) != fmt.Sprint(expected) {
+		t.Errorf("got %d servers, expected %d", len(addrs), len(expected))
+	}
+
+	// Five full pages, then a page with only the terminator.
+	if master.Requests() != 6 {
+		t.Errorf("expected 6 requests, got %d", master.Requests())
+	}
+}
+
+func TestMasterPageCallback(t *testing.T) {
+	servers := []*Entry{}
+	for i := 0; i < 250; i++ {
+		addr := fmt.Sprintf("10.0.0.%d:%d", i%100, 27015+i/100)
+		appId := valve.App_TF2
+		if i%2 == 1 {
+			appId = valve.App_CSS
+		}
+		servers = append(servers, masterEntry(addr, appId, valve.ServerType_Dedicated, ""))
+	}
+
+	master := NewMaster(servers)
+	master.PageSize = 100
+	query := startMaster(t, master)
+	query.FilterAppIds([]valve.AppId{valve.App_TF2, valve.App_CSS})
+
+	pages := []valve.MasterPage{}
+	query.SetPageCallback(func(page *valve.MasterPage) {
+		pages = append(pages, *page)
+	})
+	if _, err := queryAll(query); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each AppID has 125 servers: one full page, then the rest with the
+	// terminator.
+	expected := []valve.MasterPage{
+		{FilterIndex: 0, Page: 1, Servers: 100},
+		{FilterIndex: 0, Page: 2, Servers: 25, Done: true},
+		{FilterIndex: 1, Page: 1, Servers: 100},
+		{FilterIndex: 1, Page: 2, Servers: 25, Done: true},
+	}
+	if len(pages) != len(expected) {
+		t.Fatalf("got %d pages, expected %d: %+v", len(pages), len(expected), pages)
+	}
+	for i, page := range pages {
+		if page.FilterIndex != expected[i].FilterIndex || page.NumFilters != 2 ||
+			page.Page != expected[i].Page || page.Servers != expected[i].Servers || page.Done != expected[i].Done {
+			t.Errorf("page %d: got %+v, expected %+v", i, page, expected[i])
+		}
+	}
+}
+
+func TestMasterFilters(t *testing.T) {
+	servers := []*Entry{
+		masterEntry("10.0.0.1:27015", valve.App_TF2, valve.ServerType_Dedicated, "cp,payload"),
+		masterEntry("10.0.0.1:27016", valve.App_TF2, valve.ServerType_Listen, "cp"),
+		masterEntry("10.0.0.2:27015", valve.App_CSS, valve.ServerType_Dedicated, ""),
+		masterEntry("10.0.0.3:27015", valve.App_CSGO, valve.ServerType_HLTV, "secure"),
+		{Addr: "10.0.0.4:27015", Region: valve.Region_Europe},
+	}
+	servers[2].Info.Name = "AlliedModders CS:S"
+	servers[2].Info.Players = 0
+	servers[3].GameData = []string{"mode:competitive"}
+	servers[3].Whitelisted = true
+
+	cases := []struct {
+		filters  []valve.Filter
+		regions  []valve.Region
+		expected string
+	}{
+		{nil, nil, "[10.0.0.1:27015 10.0.0.1:27016 10.0.0.2:27015 10.0.0.3:27015 10.0.0.4:27015]"},
+		{[]valve.Filter{valve.FilterAppId(valve.App_TF2)}, nil, "[10.0.0.1:27015 10.0.0.1:27016]"},
+		{[]valve.Filter{valve.FilterNotAppId(valve.App_TF2), valve.FilterDedicated()}, nil, "[10.0.0.2:27015]"},
+		{[]valve.Filter{valve.FilterNor(valve.FilterDedicated())}, nil, "[10.0.0.1:27016 10.0.0.3:27015 10.0.0.4:27015]"},
+		{[]valve.Filter{valve.FilterGameType("payload", "CP")}, nil, "[10.0.0.1:27015]"},
+		{[]valve.Filter{valve.FilterGameDataOr("x", "mode:competitive")}, nil, "[10.0.0.3:27015]"},
+		{[]valve.Filter{valve.FilterProxy(), valve.FilterWhitelisted()}, nil, "[10.0.0.3:27015]"},
+		{[]valve.Filter{valve.FilterNameMatch("allied*")}, nil, "[10.0.0.2:27015]"},
+		{[]valve.Filter{valve.FilterNoPlayers()}, nil, "[10.0.0.2:27015 10.0.0.4:27015]"},
+		{[]valve.Filter{valve.FilterGameAddr("10.0.0.1")}, nil, "[10.0.0.1:27015 10.0.0.1:27016]"},
+		{[]valve.Filter{valve.FilterGameAddr("10.0.0.1:27016")}, nil, "[10.0.0.1:27016]"},
+		{[]valve.Filter{valve.FilterAppId(valve.App_TF2), valve.FilterCollapseAddrHash()}, nil, "[10.0.0.1:27015]"},
+		{
+			[]valve.Filter{valve.FilterOr(
+				valve.FilterAppId(valve.App_CSS),
+				valve.FilterAnd(valve.FilterAppId(valve.App_TF2), valve.FilterNand(valve.FilterDedicated())),
+			)},
+			nil,
+			"[10.0.0.1:27016 10.0.0.2:27015]",
+		},
+		{nil, []valve.Region{valve.Region_Europe}, "[10.0.0.4:27015]"},
+		{nil, []valve.Region{valve.Region_Asia}, "[]"},
+	}
+
+	master := NewMaster(servers)
+	query := startMaster(t, master)
+
+	for _, test := range cases {
+		query.ClearFilters()
+		query.AddCommonFilter(test.filters...)
+		query.SetRegions(test.regions...)
+
+		addrs, err := queryAll(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(addrs) != test.expected {
+			t.Errorf("%s: got %v, expected %s", valve.FilterList(test.filters), addrs, test.expected)
+		}
+	}
+}
+
+func TestMasterMalformedFilter(t *testing.T) {
+	for _, filter := range []string{"appid\\440", "\\appid", "\\or\\2\\appid\\440", "\\nor\\x\\appid\\440"} {
+		if _, err := parseFilter(filter); err != ErrMalformedFilter {
+			t.Errorf("%q: expected ErrMalformedFilter, got %v", filter, err)
+		}
+	}
+}
+
+func TestMasterDroppedPackets(t *testing.T) {
+	master := NewMaster([]*Entry{masterEntry("10.0.0.1:27015", valve.App_TF2, valve.ServerType_Dedicated, "")})
+	master.DropRate = 1
+	query := startMaster(t, master)
+
+	_, err := queryAll(query)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestMasterRateLimit(t *testing.T) {
+	servers := []*Entry{}
+	for i := 0; i < 10; i++ {
+		servers = append(servers, masterEntry(fmt.Sprintf("10.0.0.%d:27015", i), valve.App_TF2, valve.ServerType_Dedicated, ""))
+	}
+
+	master := NewMaster(servers)
+	master.PageSize = 2
+	master.RateLimit = 3
+	query := startMaster(t, master)
+
+	addrs, err := queryAll(query)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if len(addrs) != 6 {
+		t.Errorf("expected 3 pages before the limit, got %d servers", len(addrs))
+	}
+}
+
+func TestMasterSharding(t *testing.T) {
+	servers := []*Entry{}
+	expected := []string{}
+	for i := 0; i < 400; i++ {
+		addr := fmt.Sprintf("10.0.%d.%d:27015", i/200, i%200)
+		entry := masterEntry(addr, valve.App_TF2, valve.ServerType_Dedicated, "")
+		if i%2 == 0 {
+			entry.Info.Players = 0
+		}
+		servers = append(servers, entry)
+		expected = append(expected, addr)
+	}
+	sort.Strings(expected)
+
+	// The full list stops partway through, but each half fits.
+	master := NewMaster(servers)
+	master.PageSize = 50
+	master.MaxResults = 250
+	query := startMaster(t, master)
+	query.SetPartitions(false, valve.PartitionEmpty)
+
+	filters := map[string]bool{}
+	query.SetPageCallback(func(page *valve.MasterPage) {
+		filters[page.Filter] = true
+	})
+
+	addrs, err := queryAll(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(addrs) != fmt.Sprint(expected) {
+		t.Errorf("got %d servers, expected each of %d once", len(addrs), len(expected))
+	}
+
+	// The unsharded query, then one query for each half.
+	if len(filters) != 3 {
+		t.Errorf("expected the query to be split in two, got filters %v", filters)
+	}
+}
+
+func TestMasterResume(t *testing.T) {
+	servers := []*Entry{}
+	expected := []string{}
+	for i := 0; i < 500; i++ {
+		addr := fmt.Sprintf("10.0.%d.%d:27015", i/200, i%200)
+		servers = append(servers, masterEntry(addr, valve.App_TF2, valve.ServerType_Dedicated, ""))
+		expected = append(expected, addr)
+	}
+	sort.Strings(expected)
+
+	master := NewMaster(servers)
+	master.PageSize = 100
+	query := startMaster(t, master)
+
+	var checkpoint *valve.MasterCheckpoint
+	query.SetCheckpointCallback(func(c *valve.MasterCheckpoint) error {
+		checkpoint = c
+		return nil
+	})
+
+	// Interrupt the crawl after the second page, as Ctrl-C would.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addrs := []string{}
+	pages := 0
+	err := query.QueryContext(ctx, func(servers valve.ServerList) error {
+		for _, server := range servers {
+			addrs = append(addrs, server.String())
+		}
+		if pages++; pages == 2 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(addrs) != 200 || checkpoint == nil {
+		t.Fatalf("expected 200 servers and a checkpoint, got %d servers and %v", len(addrs), checkpoint)
+	}
+
+	// Every server is received by exactly one of the two runs.
+	resumed := newMasterQuerier(t, master)
+	resumed.Resume(checkpoint)
+	rest, err := queryAll(resumed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs = append(addrs, rest...)
+	sort.Strings(addrs)
+	if fmt.Sprint(addrs) != fmt.Sprint(expected) {
+		t.Errorf("got %d servers across both runs, expected each of %d once", len(addrs), len(expected))
+	}
+}
@@ -0,0 +1,207 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrFilterTooLong = errors.New("master filter is too long")
+
+// A Filter is a condition (or group of conditions) understood by the master
+// server. See: https://developer.valvesoftware.com/wiki/Master_Server_Query_Protocol#Filter
+type Filter interface {
+	// Returns the filter in wire format, for example "\map\de_dust".
+	String() string
+}
+
+// A single "\key\value" condition.
+type filterPair struct {
+	key   string
+	value string
+}
+
+func (this *filterPair) String() string {
+	return fmt.Sprintf("\\%s\\%s", this.key, this.value)
+}
+
+// A group of conditions, such as "\nor\2\map\de_dust\map\de_dust2". Nested
+// groups count as a single condition in the enclosing group.
+type filterGroup struct {
+	op      string
+	filters []Filter
+}
+
+func (this *filterGroup) String() string {
+	var buffer strings.Builder
+	fmt.Fprintf(&buffer, "\\%s\\%d", this.op, len(this.filters))
+	for _, filter := range this.filters {
+		buffer.WriteString(filter.String())
+	}
+	return buffer.String()
+}
+
+// A list of conditions that must all match. This is how the master treats
+// conditions at the top level, so no group header is emitted.
+type FilterList []Filter
+
+func (this FilterList) String() string {
+	var buffer strings.Builder
+	for _, filter := range this {
+		buffer.WriteString(filter.String())
+	}
+	return buffer.String()
+}
+
+// Backslashes delimit keys and values, and cannot be escaped, so they are
+// stripped from any user-supplied value.
+func filterValue(value string) string {
+	return strings.Replace(value, "\\", "", -1)
+}
+
+func newFilterPair(key string, value string) Filter {
+	return &filterPair{key: key, value: filterValue(value)}
+}
+
+func newFilterFlag(key string) Filter {
+	return newFilterPair(key, "1")
+}
+
+func newFilterTags(key string, tags []string) Filter {
+	values := make([]string, len(tags))
+	for i, tag := range tags {
+		values[i] = filterValue(tag)
+	}
+	return newFilterPair(key, strings.Join(values, ","))
+}
+
+// Servers running dedicated.
+func FilterDedicated() Filter {
+	return newFilterFlag("dedicated")
+}
+
+// Servers using anti-cheat technology (VAC).
+func FilterSecure() Filter {
+	return newFilterFlag("secure")
+}
+
+// Servers running the specified modification (for example, "cstrike").
+func FilterGameDir(dir string) Filter {
+	return newFilterPair("gamedir", dir)
+}
+
+// Servers running the specified map (for example, "cs_italy").
+func FilterMap(mapName string) Filter {
+	return newFilterPair("map", mapName)
+}
+
+// Servers running on a Linux platform.
+func FilterLinux() Filter {
+	return newFilterFlag("linux")
+}
+
+// Servers that are not empty.
+func FilterNotEmpty() Filter {
+	return newFilterFlag("empty")
+}
+
+// Servers that are not full.
+func FilterNotFull() Filter {
+	return newFilterFlag("full")
+}
+
+// Servers that are spectator proxies.
+func FilterProxy() Filter {
+	return newFilterFlag("proxy")
+}
+
+// Servers that are running the given AppId.
+func FilterAppId(appId AppId) Filter {
+	return newFilterPair("appid", fmt.Sprintf("%d", appId))
+}
+
+// Servers that are NOT running the given AppId.
+func FilterNotAppId(appId AppId) Filter {
+	return newFilterPair("napp", fmt.Sprintf("%d", appId))
+}
+
+// Servers that are empty.
+func FilterNoPlayers() Filter {
+	return newFilterFlag("noplayers")
+}
+
+// Servers that are whitelisted.
+func FilterWhitelisted() Filter {
+	return newFilterFlag("white")
+}
+
+// Servers with all of the given tag(s) in sv_tags.
+func FilterGameType(tags ...string) Filter {
+	return newFilterTags("gametype", tags)
+}
+
+// Servers with all of the given tag(s) in their 'hidden' tags (L4D2).
+func FilterGameData(tags ...string) Filter {
+	return newFilterTags("gamedata", tags)
+}
+
+// Servers with any of the given tag(s) in their 'hidden' tags (L4D2).
+func FilterGameDataOr(tags ...string) Filter {
+	return newFilterTags("gamedataor", tags)
+}
+
+// Servers with their hostname matching the given pattern. The pattern may
+// use "*" as a wildcard.
+func FilterNameMatch(pattern string) Filter {
+	return newFilterPair("name_match", pattern)
+}
+
+// Servers running a version matching the given pattern. The pattern may use
+// "*" as a wildcard.
+func FilterVersionMatch(pattern string) Filter {
+	return newFilterPair("version_match", pattern)
+}
+
+// Return only one server for each unique IP address matched.
+func FilterCollapseAddrHash() Filter {
+	return newFilterFlag("collapse_addr_hash")
+}
+
+// Return only servers on the specified IP address. The port is optional.
+func FilterGameAddr(address string) Filter {
+	return newFilterPair("gameaddr", address)
+}
+
+// Servers matching any of the given conditions.
+func FilterOr(filters ...Filter) Filter {
+	return &filterGroup{op: "or", filters: filters}
+}
+
+// Servers matching all of the given conditions. This is only useful when
+// nested inside another group.
+func FilterAnd(filters ...Filter) Filter {
+	return &filterGroup{op: "and", filters: filters}
+}
+
+// Servers matching none of the given conditions.
+func FilterNor(filters ...Filter) Filter {
+	return &filterGroup{op: "nor", filters: filters}
+}
+
+// Servers not matching all of the given conditions.
+func FilterNand(filters ...Filter) Filter {
+	return &filterGroup{op: "nand", filters: filters}
+}
+
+// A filter given in wire format, for example "\appid\440\empty\1". This is
+// sent to the master as-is.
+type RawFilter string
+
+func (this RawFilter) String() string {
+	return string(this)
+}
@@ -0,0 +1,87 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFilterStrings(t *testing.T) {
+	cases := []struct {
+		filter   Filter
+		expected string
+	}{
+		{FilterDedicated(), `\dedicated\1`},
+		{FilterNotEmpty(), `\empty\1`},
+		{FilterAppId(App_TF2), `\appid\440`},
+		{FilterNotAppId(App_CSS), `\napp\240`},
+		{FilterMap("de_dust2"), `\map\de_dust2`},
+		{FilterGameType("alltalk", "increased_maxplayers"), `\gametype\alltalk,increased_maxplayers`},
+		{FilterGameDataOr("a", "b"), `\gamedataor\a,b`},
+		{FilterCollapseAddrHash(), `\collapse_addr_hash\1`},
+		{FilterGameAddr("10.0.0.1:27015"), `\gameaddr\10.0.0.1:27015`},
+
+		// Backslashes in values would start a new key, so they are removed.
+		{FilterMap(`de_\dust`), `\map\de_dust`},
+		{FilterNameMatch(`*\appid\440*`), `\name_match\*appid440*`},
+		{FilterGameType(`a\b`, `\c`), `\gametype\ab,c`},
+
+		// Groups are prefixed with the number of conditions in them, and a
+		// nested group counts as one condition.
+		{FilterOr(FilterMap("de_dust"), FilterMap("de_dust2")), `\or\2\map\de_dust\map\de_dust2`},
+		{FilterNor(FilterDedicated()), `\nor\1\dedicated\1`},
+		{FilterNand(FilterLinux(), FilterSecure()), `\nand\2\linux\1\secure\1`},
+		{
+			FilterOr(FilterAppId(App_TF2), FilterAnd(FilterAppId(App_CSS), FilterNotEmpty())),
+			`\or\2\appid\440\and\2\appid\240\empty\1`,
+		},
+
+		{FilterList{FilterAppId(App_TF2), FilterSecure()}, `\appid\440\secure\1`},
+		{FilterList{}, ``},
+		{RawFilter(`\gametype\alltalk\nor\1\map\de_nuke`), `\gametype\alltalk\nor\1\map\de_nuke`},
+	}
+
+	for _, test := range cases {
+		if got := test.filter.String(); got != test.expected {
+			t.Errorf("got %s, expected %s", got, test.expected)
+		}
+	}
+}
+
+func TestBuildFilterStrings(t *testing.T) {
+	query := &MasterServerQuerier{}
+	query.FilterAppIds([]AppId{App_TF2, App_CSS})
+	query.AddCommonFilter(FilterSecure(), FilterNotEmpty())
+
+	strs, err := query.buildFilterStrings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`\appid\440\secure\1\empty\1`, `\appid\240\secure\1\empty\1`}
+	if fmt.Sprint(strs) != fmt.Sprint(expected) {
+		t.Errorf("got %v, expected %v", strs, expected)
+	}
+
+	// Without a filter list, the common conditions are queried alone.
+	query.ClearFilters()
+	query.AddCommonFilter(FilterLinux())
+	if strs, err = query.buildFilterStrings(); err != nil || fmt.Sprint(strs) != `[\linux\1]` {
+		t.Errorf("got %v, %v", strs, err)
+	}
+
+	// The longest filter the master accepts, and one byte more.
+	query.ClearFilters()
+	query.AddFilter(RawFilter(`\map\` + strings.Repeat("x", kMaxFilterLength-5)))
+	if _, err := query.buildFilterStrings(); err != nil {
+		t.Errorf("expected a filter of %d bytes to be accepted, got %v", kMaxFilterLength, err)
+	}
+	query.AddCommonFilter(RawFilter("x"))
+	if _, err := query.buildFilterStrings(); err != ErrFilterTooLong {
+		t.Errorf("expected ErrFilterTooLong, got %v", err)
+	}
+}
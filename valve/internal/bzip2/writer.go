@@ -0,0 +1,397 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+
+// Package bzip2 implements a small bzip2 compressor. The standard library only
+// provides a decompressor, and Valve's split packet format needs bzip2 for
+// compressed replies. It favors simplicity over compression ratio: every block
+// uses a single Huffman table.
+package bzip2
+
+import (
+	"bytes"
+	"container/heap"
+	"sort"
+)
+
+// Blocks are limited to 900k bytes after the initial run-length encoding,
+// which can grow input by at most 25%.
+const kBlockSize = 100000 * 7
+
+const kMaxCodeLength = 17
+
+// Compress returns |data| as a complete bzip2 stream.
+func Compress(data []byte) []byte {
+	return compress(data, kBlockSize)
+}
+
+func compress(data []byte, blockSize int) []byte {
+	var out bitWriter
+	out.writeBytes([]byte("BZh9"))
+
+	combined := uint32(0)
+	for len(data) > 0 {
+		n := len(data)
+		if n > blockSize {
+			n = blockSize
+		}
+
+		crc := blockCRC(data[:n])
+		combined = ((combined << 1) | (combined >> 31)) ^ crc
+		writeBlock(&out, data[:n], crc)
+		data = data[n:]
+	}
+
+	out.writeBits(24, 0x177245)
+	out.writeBits(24, 0x385090)
+	out.writeBits(32, combined)
+	return out.flush()
+}
+
+func writeBlock(out *bitWriter, block []byte, crc uint32) {
+	rle := runLengthEncode(block)
+	bwt, origPtr := burrowsWheeler(rle)
+
+	// Build the symbol map.
+	var inUse [256]bool
+	for _, b := range rle {
+		inUse[b] = true
+	}
+	var seqToUnseq []byte
+	var unseqToSeq [256]int
+	for i := 0; i < 256; i++ {
+		if inUse[i] {
+			unseqToSeq[i] = len(seqToUnseq)
+			seqToUnseq = append(seqToUnseq, byte(i))
+		}
+	}
+
+	symbols := moveToFront(bwt, seqToUnseq, unseqToSeq)
+	alphaSize := len(seqToUnseq) + 2
+	lengths := codeLengths(symbols, alphaSize)
+	codes := canonicalCodes(lengths)
+
+	// Block header.
+	out.writeBits(24, 0x314159)
+	out.writeBits(24, 0x265359)
+	out.writeBits(32, crc)
+	out.writeBits(1, 0) // Not randomized.
+	out.writeBits(24, uint32(origPtr))
+
+	// Symbol map: a bitmap of which 16-byte ranges are used, then a bitmap of
+	// bytes within each used range.
+	groups := uint32(0)
+	for i := 0; i < 16; i++ {
+		for j := 0; j < 16; j++ {
+			if inUse[i*16+j] {
+				groups |= 1 << uint(15-i)
+				break
+			}
+		}
+	}
+	out.writeBits(16, groups)
+	for i := 0; i < 16; i++ {
+		if groups&(1<<uint(15-i)) == 0 {
+			continue
+		}
+		bits := uint32(0)
+		for j := 0; j < 16; j++ {
+			if inUse[i*16+j] {
+				bits |= 1 << uint(15-j)
+			}
+		}
+		out.writeBits(16, bits)
+	}
+
+	// Two identical tables (the minimum allowed), and every group of 50
+	// symbols selects the first one.
+	numSelectors := (len(symbols) + 49) / 50
+	out.writeBits(3, 2)
+	out.writeBits(15, uint32(numSelectors))
+	for i := 0; i < numSelectors; i++ {
+		out.writeBits(1, 0)
+	}
+	for table := 0; table < 2; table++ {
+		current := lengths[0]
+		out.writeBits(5, uint32(current))
+		for _, length := range lengths {
+			for current < length {
+				out.writeBits(2, 2)
+				current++
+			}
+			for current > length {
+				out.writeBits(2, 3)
+				current--
+			}
+			out.writeBits(1, 0)
+		}
+	}
+
+	for _, symbol := range symbols {
+		out.writeBits(uint(lengths[symbol]), codes[symbol])
+	}
+}
+
+// The first stage of bzip2: runs of 4 to 255 identical bytes are replaced by
+// 4 bytes followed by a count of the remaining repeats.
+func runLengthEncode(data []byte) []byte {
+	var out bytes.Buffer
+	for i := 0; i < len(data); {
+		b := data[i]
+		run := 1
+		for i+run < len(data) && data[i+run] == b && run < 255 {
+			run++
+		}
+		if run >= 4 {
+			out.Write([]byte{b, b, b, b, byte(run - 4)})
+		} else {
+			for j := 0; j < run; j++ {
+				out.WriteByte(b)
+			}
+		}
+		i += run
+	}
+	return out.Bytes()
+}
+
+// Sort all rotations of |data| by prefix doubling, and return the last column
+// along with the position of the original string.
+func burrowsWheeler(data []byte) ([]byte, int) {
+	n := len(data)
+	index := make([]int, n)
+	rank := make([]int, n)
+	next := make([]int, n)
+	for i := range index {
+		index[i] = i
+		rank[i] = int(data[i])
+	}
+
+	for k := 1; ; k *= 2 {
+		key := func(i int) (int, int) {
+			return rank[i], rank[(i+k)%n]
+		}
+		sort.Slice(index, func(a, b int) bool {
+			a1, a2 := key(index[a])
+			b1, b2 := key(index[b])
+			if a1 != b1 {
+				return a1 < b1
+			}
+			return a2 < b2
+		})
+
+		next[index[0]] = 0
+		for i := 1; i < n; i++ {
+			a1, a2 := key(index[i-1])
+			b1, b2 := key(index[i])
+			next[index[i]] = next[index[i-1]]
+			if a1 != b1 || a2 != b2 {
+				next[index[i]]++
+			}
+		}
+		copy(rank, next)
+
+		// Stop once every rotation has a distinct rank, or once we've compared
+		// whole rotations (which happens for periodic input).
+		if rank[index[n-1]] == n-1 || k >= n {
+			break
+		}
+	}
+
+	out := make([]byte, n)
+	origPtr := 0
+	for i, start := range index {
+		out[i] = data[(start+n-1)%n]
+		if start == 0 {
+			origPtr = i
+		}
+	}
+	return out, origPtr
+}
+
+// Move-to-front transform followed by zero run-length encoding, producing
+// the final symbol stream (including the end-of-block symbol).
+func moveToFront(data []byte, seqToUnseq []byte, unseqToSeq [256]int) []uint16 {
+	const runA, runB = 0, 1
+	eob := uint16(len(seqToUnseq) + 1)
+
+	order := make([]int, len(seqToUnseq))
+	for i := range order {
+		order[i] = i
+	}
+
+	var symbols []uint16
+	flushRun := func(run int) {
+		for run--; ; run = (run - 2) / 2 {
+			if run&1 == 1 {
+				symbols = append(symbols, runB)
+			} else {
+				symbols = append(symbols, runA)
+			}
+			if run < 2 {
+				break
+			}
+		}
+	}
+
+	zeros := 0
+	for _, b := range data {
+		seq := unseqToSeq[b]
+		pos := 0
+		for order[pos] != seq {
+			pos++
+		}
+		if pos == 0 {
+			zeros++
+			continue
+		}
+		if zeros > 0 {
+			flushRun(zeros)
+			zeros = 0
+		}
+		copy(order[1:pos+1], order[:pos])
+		order[0] = seq
+		symbols = append(symbols, uint16(pos+1))
+	}
+	if zeros > 0 {
+		flushRun(zeros)
+	}
+	return append(symbols, eob)
+}
+
+type huffmanNode struct {
+	weight  int
+	symbols []int
+}
+
+type huffmanHeap []*huffmanNode
+
+func (this huffmanHeap) Len() int            { return len(this) }
+func (this huffmanHeap) Less(i, j int) bool  { return this[i].weight < this[j].weight }
+func (this huffmanHeap) Swap(i, j int)       { this[i], this[j] = this[j], this[i] }
+func (this *huffmanHeap) Push(x interface{}) { *this = append(*this, x.(*huffmanNode)) }
+func (this *huffmanHeap) Pop() interface{} {
+	old := *this
+	node := old[len(old)-1]
+	*this = old[:len(old)-1]
+	return node
+}
+
+// Compute Huffman code lengths for every symbol in the alphabet. Every symbol
+// must have a code, so unused symbols are given a weight of 1.
+func codeLengths(symbols []uint16, alphaSize int) []int {
+	freqs := make([]int, alphaSize)
+	for _, symbol := range symbols {
+		freqs[symbol]++
+	}
+
+	for {
+		lengths := make([]int, alphaSize)
+		nodes := &huffmanHeap{}
+		for symbol, freq := range freqs {
+			if freq == 0 {
+				freq = 1
+			}
+			heap.Push(nodes, &huffmanNode{weight: freq, symbols: []int{symbol}})
+		}
+		for nodes.Len() > 1 {
+			a := heap.Pop(nodes).(*huffmanNode)
+			b := heap.Pop(nodes).(*huffmanNode)
+			for _, symbol := range a.symbols {
+				lengths[symbol]++
+			}
+			for _, symbol := range b.symbols {
+				lengths[symbol]++
+			}
+			heap.Push(nodes, &huffmanNode{
+				weight:  a.weight + b.weight,
+				symbols: append(a.symbols, b.symbols...),
+			})
+		}
+
+		tooLong := false
+		for _, length := range lengths {
+			if length > kMaxCodeLength {
+				tooLong = true
+			}
+		}
+		if !tooLong {
+			return lengths
+		}
+
+		// Flatten the distribution and try again, as bzip2 does.
+		for i := range freqs {
+			freqs[i] = 1 + freqs[i]/2
+		}
+	}
+}
+
+// Assign codes in order of length, then symbol.
+func canonicalCodes(lengths []int) []uint32 {
+	codes := make([]uint32, len(lengths))
+	code := uint32(0)
+	for length := 1; length <= kMaxCodeLength; length++ {
+		for symbol, symbolLength := range lengths {
+			if symbolLength == length {
+				codes[symbol] = code
+				code++
+			}
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+var kCRCTable = (func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = (crc << 1) ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+})()
+
+// bzip2 uses a non-reflected CRC32, unlike hash/crc32.
+func blockCRC(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = (crc << 8) ^ kCRCTable[byte(crc>>24)^b]
+	}
+	return ^crc
+}
+
+type bitWriter struct {
+	out   bytes.Buffer
+	bits  uint64
+	count uint
+}
+
+func (this *bitWriter) writeBits(count uint, value uint32) {
+	this.bits = (this.bits << count) | uint64(value&((1<<count)-1))
+	this.count += count
+	for this.count >= 8 {
+		this.count -= 8
+		this.out.WriteByte(byte(this.bits >> this.count))
+	}
+}
+
+func (this *bitWriter) writeBytes(data []byte) {
+	for _, b := range data {
+		this.writeBits(8, uint32(b))
+	}
+}
+
+func (this *bitWriter) flush() []byte {
+	if this.count > 0 {
+		this.writeBits(8-this.count, 0)
+	}
+	return this.out.Bytes()
+}
@@ -0,0 +1,54 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package bzip2
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func roundTrip(t *testing.T, name string, data []byte) {
+	roundTripBlocks(t, name, data, kBlockSize)
+}
+
+func roundTripBlocks(t *testing.T, name string, data []byte, blockSize int) {
+	compressed := compress(data, blockSize)
+	out, err := ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	if !bytes.Equal(out, data) {
+		t.Errorf("%s: round trip mismatch (%d bytes in, %d bytes out)", name, len(data), len(out))
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	roundTrip(t, "single byte", []byte{'a'})
+	roundTrip(t, "text", []byte("sv_cheats\x000\x00mp_timelimit\x0030\x00"))
+	roundTrip(t, "runs", bytes.Repeat([]byte{0}, 1000))
+	roundTrip(t, "periodic", bytes.Repeat([]byte("ab"), 3000))
+	roundTrip(t, "random", random)
+	roundTripBlocks(t, "multiple blocks", bytes.Repeat([]byte("mp_friendlyfire 0\n"), 1000), 5000)
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte("hello, world"))
+	f.Add(bytes.Repeat([]byte{0xff}, 300))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		roundTrip(t, "fuzz", data)
+	})
+}
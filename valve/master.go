@@ -7,6 +7,7 @@ package valve
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"time"
@@ -19,6 +20,64 @@ var ErrBadResponseHeader = fmt.Errorf("bad response header")
 var kMasterResponseHeader = []byte{0xff, 0xff, 0xff, 0xff, 0x66, 0x0a}
 var kNullIP = net.IP([]byte{0, 0, 0, 0})
 
+// A region code understood by the master server.
+type Region uint8
+
+const (
+	Region_USEast       Region = 0x00
+	Region_USWest       Region = 0x01
+	Region_SouthAmerica Region = 0x02
+	Region_Europe       Region = 0x03
+	Region_Asia         Region = 0x04
+	Region_Australia    Region = 0x05
+	Region_MiddleEast   Region = 0x06
+	Region_Africa       Region = 0x07
+	Region_All          Region = 0xFF
+)
+
+// Every individual region. Note that servers which have not set a region
+// are only returned when querying Region_All.
+var Regions = []Region{
+	Region_USEast,
+	Region_USWest,
+	Region_SouthAmerica,
+	Region_Europe,
+	Region_Asia,
+	Region_Australia,
+	Region_MiddleEast,
+	Region_Africa,
+}
+
+var kRegionNames = map[Region]string{
+	Region_USEast:       "us-east",
+	Region_USWest:       "us-west",
+	Region_SouthAmerica: "south-america",
+	Region_Europe:       "europe",
+	Region_Asia:         "asia",
+	Region_Australia:    "australia",
+	Region_MiddleEast:   "middle-east",
+	Region_Africa:       "africa",
+	Region_All:          "all",
+}
+
+// Returns the region as a string.
+func (this Region) String() string {
+	if name, ok := kRegionNames[this]; ok {
+		return name
+	}
+	return fmt.Sprintf("region-%d", uint8(this))
+}
+
+// Parses a region name, as returned by Region.String().
+func ParseRegion(name string) (Region, error) {
+	for region, regionName := range kRegionNames {
+		if regionName == name {
+			return region, nil
+		}
+	}
+	return Region_All, fmt.Errorf("unknown region: %s", name)
+}
+
 // The callback the master query tool uses to notify of a batch of servers that
 // has just been received.
 type MasterQueryCallback func(batch ServerList) error
@@ -27,7 +86,20 @@ type MasterQueryCallback func(batch ServerList) error
 type MasterServerQuerier struct {
 	cn          *UdpSocket
 	hostAndPort string
-	filters     []string
+	filters     []Filter
+	common      FilterList
+	regions     []Region
+	partitions  []Partition
+	alwaysShard bool
+
+	// Checkpoint state.
+	current      MasterCheckpoint
+	resume       *MasterCheckpoint
+	onCheckpoint MasterCheckpointCallback
+
+	// Progress state.
+	onPage     MasterPageCallback
+	numFilters int
 }
 
 // Create a new master server querier on the given host and port.
@@ -46,15 +118,64 @@ func NewMasterServerQuerier(hostAndPort string) (*MasterServerQuerier, error) {
 	}, nil
 }
 
+// Sets how long to wait for each reply from the master.
+func (this *MasterServerQuerier) SetTimeout(timeout time.Duration) {
+	this.cn.SetTimeout(timeout)
+}
+
+// Sets the number of queries sent to the master per minute. A rate of 0
+// disables the limit, which is only appropriate for private masters.
+func (this *MasterServerQuerier) SetRateLimit(ratePerMinute int) {
+	this.cn.SetRateLimit(ratePerMinute)
+}
+
 // Adds by AppIds to the filter list.
 func (this *MasterServerQuerier) FilterAppIds(appIds []AppId) {
 	for _, appId := range appIds {
-		this.filters = append(this.filters, fmt.Sprintf("\\appid\\%d", appId))
+		this.filters = append(this.filters, FilterAppId(appId))
 	}
 }
 
+// Adds a filter to the filter list. Each filter in the list is queried
+// separately, and the results are merged.
+func (this *MasterServerQuerier) AddFilter(filter Filter) {
+	this.filters = append(this.filters, filter)
+}
+
+// Adds conditions that must match in addition to every filter in the filter
+// list. If the filter list is empty, these conditions are queried alone.
+func (this *MasterServerQuerier) AddCommonFilter(filters ...Filter) {
+	this.common = append(this.common, filters...)
+}
+
+// Sets the regions to query. Each region is queried separately, and the
+// results are merged. By default, Region_All is queried.
+func (this *MasterServerQuerier) SetRegions(regions ...Region) {
+	this.regions = regions
+}
+
 func (this *MasterServerQuerier) ClearFilters() {
-	this.filters = []string{}
+	this.filters = []Filter{}
+	this.common = FilterList{}
+}
+
+// Combine the filter list with the common conditions, returning one filter
+// string per query.
+func (this *MasterServerQuerier) buildFilterStrings() ([]string, error) {
+	filters := this.filters
+	if len(filters) == 0 {
+		filters = []Filter{FilterList{}}
+	}
+
+	strs := []string{}
+	for _, filter := range filters {
+		str := filter.String() + this.common.String()
+		if len(str) > kMaxFilterLength {
+			return nil, ErrFilterTooLong
+		}
+		strs = append(strs, str)
+	}
+	return strs, nil
 }
 
 func computeNextFilterList(filters []string) ([]string, []string) {
@@ -65,29 +186,66 @@ func computeNextFilterList(filters []string) ([]string, []string) {
 // subsequent requests, we sleep for two seconds in between each batch request.
 // This means the querying process is quite slow.
 func (this *MasterServerQuerier) Query(callback MasterQueryCallback) error {
-	filters, remaining := computeNextFilterList(this.filters)
+	return this.QueryContext(context.Background(), callback)
+}
+
+// Query the master, giving up early if the context is cancelled. Any servers
+// received before cancellation will have been passed to the callback.
+func (this *MasterServerQuerier) QueryContext(ctx context.Context, callback MasterQueryCallback) error {
+	strs, err := this.buildFilterStrings()
+	if err != nil {
+		return err
+	}
+
+	regions := this.regions
+	if len(regions) == 0 {
+		regions = []Region{Region_All}
+	}
+
+	if err := this.validateResume(strs, regions); err != nil {
+		return err
+	}
+	this.numFilters = len(strs)
+
+	// Servers can be returned by more than one query, so we remember every
+	// server seen across the whole list of queries.
+	seen := map[string]bool{}
+
+	filterIndex := 0
+	filters, remaining := computeNextFilterList(strs)
 	for {
-		if err := this.tryQuery(callback, filters); err != nil {
-			return err
+		for regionIndex, region := range regions {
+			if this.skipForResume(filterIndex, regionIndex) {
+				continue
+			}
+
+			this.current.FilterIndex = filterIndex
+			this.current.RegionIndex = regionIndex
+			this.current.Region = region
+			if err := this.queryShards(ctx, callback, region, filters[0], this.partitions, seen); err != nil {
+				return err
+			}
 		}
 
 		if len(remaining) == 0 {
 			break
 		}
 		filters, remaining = computeNextFilterList(remaining)
+		filterIndex++
 	}
 	return nil
 }
 
-// Build a packet to query the master server, given an initial starting server
-// ("0.0.0.0:0" for the initial batch) and an optional list of filter strings.
-func BuildMasterQuery(hostAndPort string, filters []string) []byte {
+// Build a packet to query the master server, given a region, an initial
+// starting server ("0.0.0.0:0" for the initial batch) and an optional list of
+// filter strings.
+func BuildMasterQuery(region Region, hostAndPort string, filters []string) []byte {
 	packet := PacketBuilder{}
 	packet.WriteByte(0x31) // Magic number
-	packet.WriteByte(0xFF) // All regions.
+	packet.WriteByte(byte(region))
 	packet.WriteCString(hostAndPort)
 
-	if len(filters) == 0 {
+	if len(filters) == 0 || (len(filters) == 1 && filters[0] == "") {
 		packet.WriteByte(0)
 		packet.WriteByte(0)
 	} else if len(filters) == 1 {
@@ -103,59 +261,35 @@ func BuildMasterQuery(hostAndPort string, filters []string) []byte {
 	return packet.Bytes()
 }
 
-func (this *MasterServerQuerier) tryQuery(callback MasterQueryCallback, filters []string) error {
-	query := BuildMasterQuery("0.0.0.0:0", filters)
-	if err := this.cn.Send(query); err != nil {
+func (this *MasterServerQuerier) tryQuery(
+	ctx context.Context,
+	callback MasterQueryCallback,
+	region Region,
+	filters []string,
+	seen map[string]bool,
+	seed string,
+) error {
+	query := BuildMasterQuery(region, seed, filters)
+	if err := this.cn.SendContext(ctx, query); err != nil {
 		return err
 	}
 
-	packet, err := this.cn.Recv()
+	packet, err := this.cn.RecvContext(ctx)
 	if err != nil {
 		return err
 	}
 
-	// Sanity check the header.
-	if len(packet) < 6 || bytes.Compare(packet[0:6], kMasterResponseHeader) != 0 {
-		return ErrBadResponseHeader
-	}
-
-	// Chop off the response header.
-	packet = packet[6:]
-
-	seen := map[string]bool{}
-
-	done := false
-	ip := kNullIP
-	port := uint16(0)
-	for {
-		reader := NewPacketReader(packet)
-		serverCount := len(packet) / 6
-
-		if serverCount == 0 {
+	for pageNumber := 1; ; pageNumber++ {
+		page, done, err := decodeMasterPage(packet)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 && !done {
 			break
 		}
 
 		servers := ServerList{}
-		for i := 0; i < serverCount; i++ {
-			ip, err = reader.ReadIPv4()
-			if err != nil {
-				return err
-			}
-			port, err = reader.ReadPort()
-			if err != nil {
-				return err
-			}
-
-			// The list is terminated with 0s.
-			if ip.Equal(kNullIP) && port == 0 {
-				done = true
-				break
-			}
-
-			addr := &net.TCPAddr{
-				IP:   ip,
-				Port: int(port),
-			}
+		for _, addr := range page {
 			if _, found := seen[addr.String()]; found {
 				continue
 			}
@@ -167,26 +301,33 @@ func (this *MasterServerQuerier) tryQuery(callback MasterQueryCallback, filters
 		if err := callback(servers); err != nil {
 			return err
 		}
+		this.notifyPage(region, filters[0], pageNumber, len(servers), done)
 
 		if done {
 			break
 		}
 
+		last := page[len(page)-1]
+		address := fmt.Sprintf("%s:%d", last.IP.String(), last.Port)
+		if err := this.recordCheckpoint(filters[0], address); err != nil {
+			return err
+		}
+
 		// Attempt to get the next batch 4 more times.
 		for i := 1; ; i++ {
-			address := fmt.Sprintf("%s:%d", ip.String(), port)
-			query := BuildMasterQuery(address, filters)
-			if err = this.cn.Send(query); err != nil {
+			query := BuildMasterQuery(region, address, filters)
+			if err = this.cn.SendContext(ctx, query); err != nil {
 				return err
 			}
 
-			if packet, err = this.cn.Recv(); err == nil {
+			if packet, err = this.cn.RecvContext(ctx); err == nil {
 				// Ok, keep going.
 				break
 			}
 
-			// Maximum number of retries before we give up.
-			if i == 4 {
+			// Maximum number of retries before we give up, or if the query
+			// has been cancelled.
+			if i == 4 || ctx.Err() != nil {
 				return err
 			}
 		}
@@ -195,6 +336,41 @@ func (this *MasterServerQuerier) tryQuery(callback MasterQueryCallback, filters
 	return nil
 }
 
+// Decode a page of results from the master server. This returns every address
+// in the page, and whether the page ends with the list terminator.
+func decodeMasterPage(packet []byte) (ServerList, bool, error) {
+	// Sanity check the header.
+	if len(packet) < 6 || !bytes.Equal(packet[0:6], kMasterResponseHeader) {
+		return nil, false, ErrBadResponseHeader
+	}
+
+	// Chop off the response header.
+	reader := NewPacketReader(packet[6:])
+
+	servers := ServerList{}
+	for reader.Remaining() >= 6 {
+		ip, err := reader.ReadIPv4()
+		if err != nil {
+			return nil, false, err
+		}
+		port, err := reader.ReadPort()
+		if err != nil {
+			return nil, false, err
+		}
+
+		// The list is terminated with 0s.
+		if ip.Equal(kNullIP) && port == 0 {
+			return servers, true, nil
+		}
+
+		servers = append(servers, &net.TCPAddr{
+			IP:   ip,
+			Port: int(port),
+		})
+	}
+	return servers, false, nil
+}
+
 func (this *MasterServerQuerier) Close() {
 	this.cn.Close()
 }
@@ -0,0 +1,37 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"testing"
+)
+
+func FuzzDecodeMasterPage(f *testing.F) {
+	// A full page, a final page with the terminator, and an empty reply,
+	// built by hand like the seeds in server_query_test.go.
+	f.Add(seedPacket(kMasterResponseHeader,
+		[]byte{192, 168, 0, 1, 0x69, 0x87},
+		[]byte{10, 0, 0, 2, 0x69, 0x88},
+	))
+	f.Add(seedPacket(kMasterResponseHeader,
+		[]byte{192, 168, 0, 1, 0x69, 0x87},
+		[]byte{0, 0, 0, 0, 0, 0},
+	))
+	f.Add(seedPacket(kMasterResponseHeader))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		servers, done, err := decodeMasterPage(data)
+		if err != nil {
+			return
+		}
+		if len(servers) > (len(data)-len(kMasterResponseHeader))/6 {
+			t.Errorf("decoded %d servers from %d bytes", len(servers), len(data))
+		}
+		if !done && len(servers) == 0 && len(data) >= len(kMasterResponseHeader)+6 {
+			t.Errorf("no progress on a non-empty page")
+		}
+	})
+}
@@ -7,9 +7,11 @@ package valve
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"time"
 )
@@ -31,9 +33,15 @@ func (this *PacketBuilder) WriteBytes(bytes []byte) {
 	this.Write(bytes)
 }
 
+// A PacketReader decodes fields from a packet. Reads never panic: if a read
+// would go past the end of the packet, it returns a zero value and the reader
+// remembers ErrOutOfBounds, which is returned by Err(). Every read after the
+// first failure also returns a zero value, so callers can decode a whole
+// structure and check Err() once at the end.
 type PacketReader struct {
 	buffer []byte
 	pos    int
+	err    error
 }
 
 func NewPacketReader(packet []byte) *PacketReader {
@@ -48,9 +56,18 @@ func (this *PacketReader) dumpRemaining() {
 	fmt.Printf("%+v\n", this.buffer[this.pos:])
 }
 
+// Returns the first error encountered while reading, or nil.
+func (this *PacketReader) Err() error {
+	return this.err
+}
+
 func (this *PacketReader) canRead(size int) error {
-	if size+this.pos > len(this.buffer) {
-		return ErrOutOfBounds
+	if this.err != nil {
+		return this.err
+	}
+	if size < 0 || size > len(this.buffer)-this.pos {
+		this.err = ErrOutOfBounds
+		return this.err
 	}
 	return nil
 }
@@ -68,6 +85,11 @@ func (this *PacketReader) Pos() int {
 	return this.pos
 }
 
+// Returns the number of unread bytes. This does not affect Err().
+func (this *PacketReader) Remaining() int {
+	return len(this.buffer) - this.pos
+}
+
 func (this *PacketReader) ReadIPv4() (net.IP, error) {
 	if err := this.canRead(net.IPv4len); err != nil {
 		return nil, err
@@ -89,18 +111,27 @@ func (this *PacketReader) ReadPort() (uint16, error) {
 }
 
 func (this *PacketReader) ReadUint8() uint8 {
+	if this.canRead(1) != nil {
+		return 0
+	}
 	b := this.buffer[this.pos]
 	this.pos++
 	return b
 }
 
 func (this *PacketReader) ReadUint16() uint16 {
+	if this.canRead(2) != nil {
+		return 0
+	}
 	u16 := binary.LittleEndian.Uint16(this.buffer[this.pos:])
 	this.pos += 2
 	return u16
 }
 
 func (this *PacketReader) ReadUint32() uint32 {
+	if this.canRead(4) != nil {
+		return 0
+	}
 	u32 := binary.LittleEndian.Uint32(this.buffer[this.pos:])
 	this.pos += 4
 	return u32
@@ -111,12 +142,25 @@ func (this *PacketReader) ReadInt32() int32 {
 }
 
 func (this *PacketReader) ReadUint64() uint64 {
+	if this.canRead(8) != nil {
+		return 0
+	}
 	u64 := binary.LittleEndian.Uint64(this.buffer[this.pos:])
 	this.pos += 8
 	return u64
 }
 
+func (this *PacketReader) ReadFloat32() float32 {
+	return math.Float32frombits(this.ReadUint32())
+}
+
+// Read a null-terminated string. If there is no terminator, this returns
+// false, but does not affect Err().
 func (this *PacketReader) TryReadString() (string, bool) {
+	if this.err != nil {
+		return "", false
+	}
+
 	start := this.pos
 	for this.pos < len(this.buffer) {
 		if this.buffer[this.pos] == 0 {
@@ -128,22 +172,27 @@ func (this *PacketReader) TryReadString() (string, bool) {
 	return "", false
 }
 
+// Read a null-terminated string. If there is no terminator, this returns an
+// empty string and sets Err() to ErrOutOfBounds.
 func (this *PacketReader) ReadString() string {
-	start := this.pos
-	for {
-		// Note: it's intended that we panic for strings that are not null
-		// terminated.
-		if this.buffer[this.pos] == 0 {
-			this.pos++
-			break
-		}
-		this.pos++
+	str, ok := this.TryReadString()
+	if !ok && this.err == nil {
+		this.err = ErrOutOfBounds
 	}
-	return string(this.buffer[start : this.pos-1])
+	return str
 }
 
 func (this *PacketReader) More() bool {
-	return this.pos < len(this.buffer)
+	return this.err == nil && this.pos < len(this.buffer)
+}
+
+// A QuerySocket exchanges packets with a single remote address.
+type QuerySocket interface {
+	SendContext(ctx context.Context, bytes []byte) error
+	RecvContext(ctx context.Context) ([]byte, error)
+	SetTimeout(timeout time.Duration)
+	RemoteAddr() net.Addr
+	Close()
 }
 
 type UdpSocket struct {
@@ -174,7 +223,12 @@ func (this *UdpSocket) RemoteAddr() net.Addr {
 	return this.cn.RemoteAddr()
 }
 
+// Limits the number of packets sent per minute. A rate of 0 disables the limit.
 func (this *UdpSocket) SetRateLimit(ratePerMinute int) {
+	if ratePerMinute <= 0 {
+		this.wait = 0
+		return
+	}
 	this.wait = (time.Minute / time.Duration(ratePerMinute)) + time.Second
 }
 
@@ -182,14 +236,24 @@ func (this *UdpSocket) extendedDeadline() time.Time {
 	return time.Now().Add(this.timeout)
 }
 
-func (this *UdpSocket) enforceRateLimit() {
+func (this *UdpSocket) enforceRateLimit(ctx context.Context) error {
 	if this.wait == 0 {
-		return
+		return nil
 	}
 
 	wait := this.next.Sub(time.Now())
-	if wait > 0 {
-		time.Sleep(wait)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -199,8 +263,40 @@ func (this *UdpSocket) setNextQueryTime() {
 	}
 }
 
+// Interrupts a blocking read if the context is cancelled. The returned function
+// must be called once the read has returned.
+func (this *UdpSocket) interruptOnDone(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go (func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			this.cn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	})()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
 func (this *UdpSocket) Send(bytes []byte) error {
-	this.enforceRateLimit()
+	return this.SendContext(context.Background(), bytes)
+}
+
+// Send a packet, giving up early if the context is cancelled while waiting
+// on the rate limit.
+func (this *UdpSocket) SendContext(ctx context.Context, bytes []byte) error {
+	if err := this.enforceRateLimit(ctx); err != nil {
+		return err
+	}
 	defer this.setNextQueryTime()
 
 	// Set timeout.
@@ -214,15 +310,33 @@ func (this *UdpSocket) Send(bytes []byte) error {
 }
 
 func (this *UdpSocket) Recv() ([]byte, error) {
+	return this.RecvContext(context.Background())
+}
+
+// Receive a packet, giving up early if the context is cancelled.
+func (this *UdpSocket) RecvContext(ctx context.Context) ([]byte, error) {
 	defer this.setNextQueryTime()
 
-	// Set timeout.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Set timeout. If there's no timeout, we still clear any deadline left
+	// over from an earlier cancellation.
 	if this.timeout > 0 {
 		this.cn.SetReadDeadline(this.extendedDeadline())
+	} else {
+		this.cn.SetReadDeadline(time.Time{})
 	}
 
+	stop := this.interruptOnDone(ctx)
 	n, err := this.cn.Read(this.buffer[0:kMaxPacketSize])
+	stop()
+
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
 
@@ -0,0 +1,90 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Returns the address of a UDP listener that never replies.
+func silentListener(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+// Runs fn with a context that is cancelled shortly after it starts, and checks
+// that it returns context.Canceled long before any timeout.
+func expectCancel(t *testing.T, fn func(ctx context.Context) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(time.Millisecond*50, cancel)
+
+	start := time.Now()
+	err := fn(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v to cancel", elapsed)
+	}
+}
+
+func TestRecvContextCancel(t *testing.T) {
+	socket, err := NewUdpSocket(silentListener(t), time.Second*30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	expectCancel(t, func(ctx context.Context) error {
+		_, err := socket.RecvContext(ctx)
+		return err
+	})
+
+	// The socket is still usable after a cancelled read.
+	socket.SetTimeout(time.Millisecond * 50)
+	if _, err := socket.Recv(); !isTimeout(err) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestQueryInfoContextCancel(t *testing.T) {
+	query, err := NewServerQuerier(silentListener(t), time.Second*30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer query.Close()
+
+	expectCancel(t, func(ctx context.Context) error {
+		_, err := query.QueryInfoContext(ctx)
+		return err
+	})
+}
+
+func TestRateLimitCancel(t *testing.T) {
+	socket, err := NewUdpSocket(silentListener(t), time.Second*30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	// The second packet has to wait about a minute.
+	socket.SetRateLimit(1)
+	if err := socket.Send([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	expectCancel(t, func(ctx context.Context) error {
+		return socket.SendContext(ctx, []byte{0})
+	})
+}
@@ -0,0 +1,53 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+// Describes a page of results received from the master, for progress
+// reporting.
+type MasterPage struct {
+	// Index into the filter list, and the length of the filter list.
+	FilterIndex int
+	NumFilters  int
+
+	Region Region
+
+	// The exact filter string queried, which differs from the filter list
+	// entry if the query has been sharded.
+	Filter string
+
+	// The page number within this filter string and region, starting at 1.
+	Page int
+
+	// The number of servers in the page that had not been seen before.
+	Servers int
+
+	// Whether this was the last page for this filter string and region.
+	Done bool
+}
+
+// The callback used to notify of each page received from the master. It is
+// invoked after the page's servers have been passed to the query callback.
+type MasterPageCallback func(page *MasterPage)
+
+// Sets a callback to be notified of each page received from the master.
+func (this *MasterServerQuerier) SetPageCallback(callback MasterPageCallback) {
+	this.onPage = callback
+}
+
+func (this *MasterServerQuerier) notifyPage(region Region, filter string, page int, servers int, done bool) {
+	if this.onPage == nil {
+		return
+	}
+	this.onPage(&MasterPage{
+		FilterIndex: this.current.FilterIndex,
+		NumFilters:  this.numFilters,
+		Region:      region,
+		Filter:      filter,
+		Page:        page,
+		Servers:     servers,
+		Done:        done,
+	})
+}
@@ -0,0 +1,203 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var kInfoQueryString = []byte("Source Engine Query\x00")
+
+// A Responder answers A2S_INFO, A2S_RULES, and A2S_PLAYER queries on behalf of
+// a game server, so that it can appear in server browsers. The server state
+// may be updated while the responder is serving.
+type Responder struct {
+	lock    sync.RWMutex
+	info    *ServerInfo
+	rules   map[string]string
+	players []*PlayerInfo
+
+	challengeInfo bool
+	answerRules   bool
+	answerPlayers bool
+	splitSize     int
+	compress      bool
+	secret        []byte
+	splitId       uint32
+}
+
+// Create a new responder for a server with the given info. The info's
+// InfoVersion decides whether replies use the GoldSrc or Source formats. If
+// info is nil, nothing is answered until SetInfo is called.
+func NewResponder(info *ServerInfo) (*Responder, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return &Responder{
+		info:          info,
+		rules:         map[string]string{},
+		answerRules:   true,
+		answerPlayers: true,
+		splitSize:     kDefaultSplitSize,
+		secret:        secret,
+	}, nil
+}
+
+// Replace the server info. While the info is nil, no queries are answered.
+func (this *Responder) SetInfo(info *ServerInfo) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.info = info
+}
+
+// Replace the server rules.
+func (this *Responder) SetRules(rules map[string]string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.rules = rules
+}
+
+// Replace the player list.
+func (this *Responder) SetPlayers(players []*PlayerInfo) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.players = players
+}
+
+// Require a challenge for A2S_INFO, as newer Source servers do.
+func (this *Responder) SetChallengeInfo(challengeInfo bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.challengeInfo = challengeInfo
+}
+
+// Answer A2S_RULES queries (the default). When disabled, they are ignored,
+// as by servers that refuse rules queries.
+func (this *Responder) SetAnswerRules(answer bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.answerRules = answer
+}
+
+// Answer A2S_PLAYER queries (the default). When disabled, they are ignored.
+func (this *Responder) SetAnswerPlayers(answer bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.answerPlayers = answer
+}
+
+// Split replies with payloads larger than this many bytes. The default is the
+// size used by Source servers.
+func (this *Responder) SetSplitSize(splitSize int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.splitSize = splitSize
+}
+
+// Compress split replies with bzip2. This only applies to Source servers that
+// are not pre-Orange Box.
+func (this *Responder) SetCompression(compress bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.compress = compress
+}
+
+// Returns the challenge number a client must send. Challenges are derived
+// from the client's address, so no state is kept for each client.
+func (this *Responder) Challenge(addr net.Addr) uint32 {
+	mac := hmac.New(sha256.New, this.secret)
+	mac.Write([]byte(addr.String()))
+
+	// A challenge of -1 means the client is asking for one.
+	return binary.LittleEndian.Uint32(mac.Sum(nil)) & 0x7fffffff
+}
+
+func (this *Responder) hasChallenge(data []byte, addr net.Addr) bool {
+	return len(data) >= 4 && binary.LittleEndian.Uint32(data) == this.Challenge(addr)
+}
+
+// Returns the packets to send in reply to a request from addr. Unrecognized
+// requests return nil.
+func (this *Responder) HandlePacket(request []byte, addr net.Addr) [][]byte {
+	if len(request) < 5 || binary.LittleEndian.Uint32(request) != 0xffffffff {
+		return nil
+	}
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if this.info == nil {
+		return nil
+	}
+
+	payload := request[5:]
+	switch request[4] {
+	case A2S_INFO:
+		if !bytes.HasPrefix(payload, kInfoQueryString) {
+			return nil
+		}
+		if this.challengeInfo && !this.hasChallenge(payload[len(kInfoQueryString):], addr) {
+			return [][]byte{EncodeChallengeReply(this.Challenge(addr))}
+		}
+		return [][]byte{EncodeInfoReply(this.info)}
+	case A2S_RULES:
+		if !this.answerRules {
+			return nil
+		}
+		if !this.hasChallenge(payload, addr) {
+			return [][]byte{EncodeChallengeReply(this.Challenge(addr))}
+		}
+		return this.split(EncodeRulesReply(this.rules))
+	case A2S_PLAYER:
+		if !this.answerPlayers {
+			return nil
+		}
+		if !this.hasChallenge(payload, addr) {
+			return [][]byte{EncodeChallengeReply(this.Challenge(addr))}
+		}
+		return this.split(EncodePlayersReply(this.players, this.info.TheShip != nil))
+	}
+	return nil
+}
+
+func (this *Responder) split(reply []byte) [][]byte {
+	id := atomic.AddUint32(&this.splitId, 1)
+	packets, err := SplitReply(this.info, id, reply, this.splitSize, this.compress)
+	if err != nil {
+		return nil
+	}
+	return packets
+}
+
+// Answer queries received on conn until it is closed.
+func (this *Responder) Serve(conn net.PacketConn) error {
+	buffer := make([]byte, 1400)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		for _, reply := range this.HandlePacket(buffer[:n], addr) {
+			if _, err := conn.WriteTo(reply, addr); err != nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncodeInfoReply(t *testing.T) {
+	querier := &ServerQuerier{}
+	for _, seed := range [][]byte{kSeedSourceInfo, kSeedGoldSrcInfo, kSeedTheShipInfo, kSeedPreOrangeBoxInfo} {
+		info := &ServerInfo{}
+		if err := querier.parse_a2s_info_reply(info, seed); err != nil {
+			t.Fatal(err)
+		}
+		if encoded := EncodeInfoReply(info); !bytes.Equal(encoded, seed) {
+			t.Errorf("encoded %x, expected %x", encoded, seed)
+		}
+	}
+}
+
+func TestEncodePlayersReply(t *testing.T) {
+	querier := newFuzzQuerier(3)
+	players, err := querier.processPlayers(kSeedTheShipPlayers, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded := EncodePlayersReply(players, true); !bytes.Equal(encoded, kSeedTheShipPlayers) {
+		t.Errorf("encoded %x, expected %x", encoded, kSeedTheShipPlayers)
+	}
+}
+
+func TestSplitReplyTooLarge(t *testing.T) {
+	info := &ServerInfo{InfoVersion: S2A_INFO_GOLDSRC}
+	if _, err := SplitReply(info, 1, make([]byte, 16*100), 100, false); err != ErrReplyTooLarge {
+		t.Errorf("expected ErrReplyTooLarge, got %v", err)
+	}
+	if packets, err := SplitReply(info, 1, make([]byte, 15*100), 100, false); err != nil || len(packets) != 15 {
+		t.Errorf("expected 15 packets, got %d (%v)", len(packets), err)
+	}
+}
+
+func TestResponderChallenge(t *testing.T) {
+	responder, err := NewResponder(&ServerInfo{InfoVersion: S2A_INFO_SOURCE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 27005}
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 27005}
+
+	request := func(challenge uint32) []byte {
+		return seedPacket(kOOBHeader, A2S_RULES, challenge)
+	}
+
+	replies := responder.HandlePacket(request(0xffffffff), addr)
+	if len(replies) != 1 || replies[0][4] != S2C_CHALLENGE {
+		t.Fatalf("expected a challenge, got %x", replies)
+	}
+	challenge := binary.LittleEndian.Uint32(replies[0][5:])
+
+	replies = responder.HandlePacket(request(challenge), addr)
+	if len(replies) != 1 || replies[0][4] != S2A_RULES {
+		t.Errorf("expected rules, got %x", replies)
+	}
+
+	// Another client can't reuse the challenge.
+	replies = responder.HandlePacket(request(challenge), other)
+	if len(replies) != 1 || replies[0][4] != S2C_CHALLENGE {
+		t.Errorf("expected a challenge, got %x", replies)
+	}
+}
+
+func TestResponderDisabledQueries(t *testing.T) {
+	responder, err := NewResponder(&ServerInfo{InfoVersion: S2A_INFO_SOURCE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder.SetAnswerRules(false)
+	responder.SetAnswerPlayers(false)
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 27005}
+
+	// Disabled queries get no reply at all, not even a challenge.
+	for _, kind := range []uint8{A2S_RULES, A2S_PLAYER} {
+		for _, challenge := range []uint32{0xffffffff, responder.Challenge(addr)} {
+			if replies := responder.HandlePacket(seedPacket(kOOBHeader, kind, challenge), addr); replies != nil {
+				t.Errorf("%#x: expected no reply, got %x", kind, replies)
+			}
+		}
+	}
+
+	if replies := responder.HandlePacket(seedPacket(kOOBHeader, A2S_INFO, "Source Engine Query"), addr); len(replies) != 1 || replies[0][4] != S2A_INFO_SOURCE {
+		t.Errorf("expected info, got %x", replies)
+	}
+
+	responder.SetAnswerPlayers(true)
+	replies := responder.HandlePacket(seedPacket(kOOBHeader, A2S_PLAYER, responder.Challenge(addr)), addr)
+	if len(replies) != 1 || replies[0][4] != S2A_PLAYER {
+		t.Errorf("expected players, got %x", replies)
+	}
+}
+
+func TestResponderServe(t *testing.T) {
+	info := &ServerInfo{
+		InfoVersion: S2A_INFO_SOURCE,
+		Protocol:    17,
+		Name:        "Responder",
+		MapName:     "ctf_2fort",
+		Folder:      "tf",
+		Game:        "Team Fortress",
+		MaxPlayers:  24,
+		Type:        ServerType_Dedicated,
+		OS:          ServerOS_Linux,
+		Ext:         &ExtendedInfo{AppId: App_TF2, GameVersion: "1.0", GameId: uint64(App_TF2)},
+	}
+	rules := map[string]string{}
+	for i := 0; i < 200; i++ {
+		rules[fmt.Sprintf("rule%d", i)] = fmt.Sprintf("value%d", i)
+	}
+	players := []*PlayerInfo{{Index: 0, Name: "Scout", Score: 10, Duration: 12.5}}
+
+	responder, err := NewResponder(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder.SetRules(rules)
+	responder.SetPlayers(players)
+	responder.SetChallengeInfo(true)
+	responder.SetCompression(true)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go (func() {
+		done <- responder.Serve(conn)
+	})()
+
+	query, err := NewServerQuerier(conn.LocalAddr().String(), time.Second*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer query.Close()
+
+	gotInfo, err := query.QueryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotInfo.Name != info.Name || gotInfo.Ext.AppId != App_TF2 {
+		t.Errorf("got info %+v", gotInfo)
+	}
+
+	gotRules, err := query.QueryRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotRules, rules) {
+		t.Errorf("got %d rules, expected %d", len(gotRules), len(rules))
+	}
+
+	gotPlayers, err := query.QueryPlayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotPlayers, players) {
+		t.Errorf("got players %+v", gotPlayers)
+	}
+
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+}
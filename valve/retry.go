@@ -0,0 +1,125 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// A RetryPolicy controls how ServerQuerier retries request/reply exchanges
+// that time out. Each exchange (the A2S_INFO request, each challenge request,
+// and each challenged A2S_RULES or A2S_PLAYER request) is retried on its own,
+// so a lost challenge does not use up the retries for the query itself.
+// Packets after the first in a split reply are not retried.
+type RetryPolicy struct {
+	// The total number of attempts for each exchange. Values below 1 are
+	// treated as 1, meaning no retries.
+	Attempts int
+
+	// How long to wait for a reply to each attempt. If 0, the querier's
+	// timeout is used.
+	Timeout time.Duration
+
+	// How long to wait before the first retry. The wait doubles after each
+	// further retry, up to MaxBackoff if it is non-zero.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// The wait before the given retry (starting at 1).
+func (this *RetryPolicy) backoff(retry int) time.Duration {
+	wait := this.Backoff
+	for i := 1; i < retry; i++ {
+		if this.MaxBackoff > 0 && wait >= this.MaxBackoff {
+			break
+		}
+		wait *= 2
+	}
+	if this.MaxBackoff > 0 && wait > this.MaxBackoff {
+		wait = this.MaxBackoff
+	}
+	return wait
+}
+
+// Sets the retry policy for future queries.
+func (this *ServerQuerier) SetRetryPolicy(policy RetryPolicy) {
+	this.retry = policy
+}
+
+// Send a request and wait for a reply, retrying according to the retry
+// policy if the reply times out. The round-trip time is returned along with
+// the reply. It is measured from the first attempt, since a reply received
+// after a retry may be a late reply to an earlier attempt; this overstates
+// the ping of servers that lose packets rather than understating it.
+//
+// If reply types are given, single-packet replies of any other type are
+// discarded while waiting. Retries can leave late replies queued on the
+// socket, such as a second S2C_CHALLENGE, and these would otherwise be read
+// as the reply to the next request.
+func (this *ServerQuerier) exchange(ctx context.Context, request []byte, replies ...uint8) ([]byte, time.Duration, error) {
+	timeout := this.retry.Timeout
+	if timeout == 0 {
+		timeout = this.timeout
+	}
+	defer this.socket.SetTimeout(this.timeout)
+
+	var sent time.Time
+	for attempt := 1; ; attempt++ {
+		if err := this.socket.SendContext(ctx, request); err != nil {
+			return nil, 0, err
+		}
+		attemptSent := time.Now()
+		if attempt == 1 {
+			sent = attemptSent
+		}
+
+		this.socket.SetTimeout(timeout)
+		data, err := this.socket.RecvContext(ctx)
+		for err == nil && !isExpectedReply(data, replies) {
+			remaining := timeout - time.Since(attemptSent)
+			if timeout > 0 && remaining <= 0 {
+				err = os.ErrDeadlineExceeded
+				break
+			}
+			if timeout > 0 {
+				this.socket.SetTimeout(remaining)
+			}
+			data, err = this.socket.RecvContext(ctx)
+		}
+		if err == nil {
+			return data, time.Since(sent), nil
+		}
+		if !isTimeout(err) || ctx.Err() != nil || attempt >= this.retry.Attempts {
+			return nil, 0, err
+		}
+
+		if wait := this.retry.backoff(attempt); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, 0, ctx.Err()
+			}
+		}
+	}
+}
+
+// Returns whether a packet is one of the given reply types. Split packets
+// and packets too short to have a type are left for the caller to check.
+func isExpectedReply(data []byte, replies []uint8) bool {
+	if len(replies) == 0 || packetHeader(data) != -1 || len(data) < 5 {
+		return true
+	}
+	for _, reply := range replies {
+		if data[4] == reply {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{Backoff: time.Millisecond * 100, MaxBackoff: time.Millisecond * 300}
+	expected := []time.Duration{100, 200, 300, 300}
+	for i, wait := range expected {
+		if got := policy.backoff(i + 1); got != wait*time.Millisecond {
+			t.Errorf("retry %d: expected %v, got %v", i+1, wait*time.Millisecond, got)
+		}
+	}
+
+	policy = RetryPolicy{}
+	if got := policy.backoff(3); got != 0 {
+		t.Errorf("expected no backoff, got %v", got)
+	}
+}
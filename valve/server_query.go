@@ -8,6 +8,7 @@ package valve
 import (
 	"bytes"
 	"compress/bzip2"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -25,6 +26,7 @@ var ErrDuplicatePacket = errors.New("received duplicate numbered packets")
 var ErrBadPacketNumber = errors.New("packet number is out of sequence")
 var ErrConfusedChallengeReply = errors.New("challenge reply is for the wrong query")
 var ErrBadRulesReply = errors.New("bad rules reply")
+var ErrBadPlayersReply = errors.New("bad players reply")
 var ErrWrongBz2Size = errors.New("bad bz2 decompression size")
 var ErrWrongBz2Checksum = errors.New("bad bz2 checksum")
 
@@ -33,8 +35,9 @@ var _ = fmt.Println
 
 // A ServerQuerier is used to issue A2S queries against an HL1/HL2 server.
 type ServerQuerier struct {
-	socket  *UdpSocket
+	socket  QuerySocket
 	timeout time.Duration
+	retry   RetryPolicy
 	info    *ServerInfo
 }
 
@@ -42,12 +45,18 @@ type ServerQuerier struct {
 func NewServerQuerier(hostAndPort string, timeout time.Duration) (*ServerQuerier, error) {
 	socket, err := NewUdpSocket(hostAndPort, timeout)
 	if err != nil {
-		return nil, err
+		return nil, newQueryError(Phase_Dial, err)
 	}
+	return NewServerQuerierFromSocket(socket, timeout), nil
+}
+
+// Create a new server querying object that uses an existing socket, such as
+// one from SharedUdpSocket.Dial(). The querier takes ownership of the socket.
+func NewServerQuerierFromSocket(socket QuerySocket, timeout time.Duration) *ServerQuerier {
 	return &ServerQuerier{
 		socket:  socket,
 		timeout: timeout,
-	}, nil
+	}
 }
 
 // Close the socket used to query.
@@ -57,15 +66,21 @@ func (this *ServerQuerier) Close() {
 
 // Query a server's info via A2S_INFO.
 func (this *ServerQuerier) QueryInfo() (*ServerInfo, error) {
+	return this.QueryInfoContext(context.Background())
+}
+
+// Query a server's info via A2S_INFO, giving up early if the context is
+// cancelled.
+func (this *ServerQuerier) QueryInfoContext(ctx context.Context) (*ServerInfo, error) {
 	this.info = &ServerInfo{
 		Address: this.socket.RemoteAddr().String(),
 	}
 
 	err := Try(func() error {
-		return this.a2s_info(this.info)
+		return this.a2s_info(ctx, this.info)
 	})
 	if err != nil && err != ErrMistakenReply {
-		return nil, err
+		return nil, newQueryError(Phase_Info, err)
 	}
 
 	// Mysteriously, Half-Life 1 servers will often reply to an A2S_INFO with
@@ -73,7 +88,7 @@ func (this *ServerQuerier) QueryInfo() (*ServerInfo, error) {
 	// up to three extra packets with a very small timeout.
 	if err == ErrMistakenReply || this.info.InfoVersion == S2A_INFO_GOLDSRC {
 		err := Try(func() error {
-			return this.check_bad_a2s_info(this.info)
+			return this.check_bad_a2s_info(ctx, this.info)
 		})
 		if err == nil {
 			return this.info, nil
@@ -81,21 +96,21 @@ func (this *ServerQuerier) QueryInfo() (*ServerInfo, error) {
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, newQueryError(Phase_Info, err)
 	}
 	return this.info, nil
 }
 
-func (this *ServerQuerier) check_bad_a2s_info(info *ServerInfo) error {
+func (this *ServerQuerier) check_bad_a2s_info(ctx context.Context, info *ServerInfo) error {
 	this.socket.SetTimeout(time.Millisecond * 250)
 	defer this.socket.SetTimeout(this.timeout)
 
-	data1, err := this.socket.Recv()
+	data1, err := this.socket.RecvContext(ctx)
 	if err != nil {
 		return err
 	}
 
-	data2, err := this.socket.Recv()
+	data2, err := this.socket.RecvContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -107,32 +122,32 @@ func (this *ServerQuerier) check_bad_a2s_info(info *ServerInfo) error {
 	return this.parse_a2s_info_reply(this.info, data2)
 }
 
-func (this *ServerQuerier) a2s_info(info *ServerInfo) error {
+func (this *ServerQuerier) a2s_info(ctx context.Context, info *ServerInfo) error {
 	var packet PacketBuilder
 	packet.WriteBytes([]byte{0xff, 0xff, 0xff, 0xff, A2S_INFO})
 	packet.WriteCString("Source Engine Query")
-	if err := this.socket.Send(packet.Bytes()); err != nil {
-		return err
-	}
-
-	data, err := this.socket.Recv()
+	data, ping, err := this.exchange(ctx, packet.Bytes())
 	if err != nil {
 		return err
 	}
+	info.Ping = ping
+	if len(data) < 5 {
+		return ErrBadPacketHeader
+	}
 
 	switch data[4] {
 	case S2C_CHALLENGE:
 		// The newer protocol requires A2S_INFO requests to contain a challenge,
 		// servers that expected a challenge will have sent us a S2C_CHALLENGE response instead.
 		// Re-send the query with the challenge we received.
+		if len(data) < 9 {
+			return ErrBadChallengeResponse
+		}
 		packet.WriteBytes([]byte{
 			data[5], data[6], data[7], data[8],
 		})
-		if err := this.socket.Send(packet.Bytes()); err != nil {
-			return err
-		}
-
-		data, err = this.socket.Recv()
+		info.ChallengePing = info.Ping
+		data, info.Ping, err = this.exchange(ctx, packet.Bytes(), S2A_INFO_SOURCE, S2A_INFO_GOLDSRC, S2A_PLAYER)
 		if err != nil {
 			return err
 		}
@@ -161,7 +176,7 @@ func (this *ServerQuerier) parse_a2s_info_reply(info *ServerInfo, data []byte) e
 	default:
 		return ErrUnknownInfoVersion
 	}
-	return nil
+	return reader.Err()
 }
 
 func (this *ServerQuerier) parseNewInfo(reader *PacketReader, info *ServerInfo) {
@@ -298,39 +313,37 @@ func (this *ServerQuerier) parseOldInfo(reader *PacketReader, info *ServerInfo)
 // Send an A2S_RULES query to the server. This returns a mapping of cvar names
 // to values.
 func (this *ServerQuerier) QueryRules() (map[string]string, error) {
+	return this.QueryRulesContext(context.Background())
+}
+
+// Send an A2S_RULES query to the server, giving up early if the context is
+// cancelled.
+func (this *ServerQuerier) QueryRulesContext(ctx context.Context) (map[string]string, error) {
 	var rules map[string]string
 	var err error
 
 	// Note: must assign |err| in case there's a panic.
 	err = Try(func() error {
-		rules, err = this.queryRules()
+		rules, err = this.queryRules(ctx)
 		return err
 	})
 
-	return rules, err
+	return rules, newQueryError(Phase_Rules, err)
 }
 
-func (this *ServerQuerier) queryRules() (map[string]string, error) {
-	// Try to get a successful challenge.
-	rechallenges := 0
-	data, err := this.a2s_rules()
-	for err == ErrConfusedChallengeReply && rechallenges < 3 {
-		data, err = this.a2s_rules()
-		rechallenges++
-	}
-
-	// Challenge failed - abort.
+func (this *ServerQuerier) queryRules(ctx context.Context) (map[string]string, error) {
+	data, err := this.challengeQuery(ctx, A2S_RULES, S2A_RULES)
 	if err != nil {
 		return nil, err
 	}
 
-	switch int32(binary.LittleEndian.Uint32(data)) {
+	switch packetHeader(data) {
 	case -1:
 		return this.processRules(data, false)
 	case -2:
-		full, compressed, err := this.waitForMultiPacketReply(data)
+		full, compressed, err := this.waitForMultiPacketReply(ctx, data)
 		if err != nil {
-			return nil, err
+			return nil, newQueryError(Phase_MultiPacket, err)
 		}
 		return this.processRules(full, compressed)
 	default:
@@ -338,22 +351,79 @@ func (this *ServerQuerier) queryRules() (map[string]string, error) {
 	}
 }
 
-func (this *ServerQuerier) a2s_rules() ([]byte, error) {
-	data := []byte{
-		0xff, 0xff, 0xff, 0xff,
-		A2S_RULES,
-		0xff, 0xff, 0xff, 0xff,
-	}
-	if err := this.socket.Send(data); err != nil {
+// Send an A2S_PLAYER query to the server. This returns the list of players
+// currently on the server. As with rules, A2S_INFO should be queried first,
+// since split replies can only be decoded once the game engine is known.
+func (this *ServerQuerier) QueryPlayers() ([]*PlayerInfo, error) {
+	return this.QueryPlayersContext(context.Background())
+}
+
+// Send an A2S_PLAYER query to the server, giving up early if the context is
+// cancelled.
+func (this *ServerQuerier) QueryPlayersContext(ctx context.Context) ([]*PlayerInfo, error) {
+	var players []*PlayerInfo
+	var err error
+
+	// Note: must assign |err| in case there's a panic.
+	err = Try(func() error {
+		players, err = this.queryPlayers(ctx)
+		return err
+	})
+
+	return players, newQueryError(Phase_Players, err)
+}
+
+func (this *ServerQuerier) queryPlayers(ctx context.Context) ([]*PlayerInfo, error) {
+	data, err := this.challengeQuery(ctx, A2S_PLAYER, S2A_PLAYER)
+	if err != nil {
 		return nil, err
 	}
 
-	data, err := this.socket.Recv()
+	switch packetHeader(data) {
+	case -1:
+		return this.processPlayers(data, false)
+	case -2:
+		full, compressed, err := this.waitForMultiPacketReply(ctx, data)
+		if err != nil {
+			return nil, newQueryError(Phase_MultiPacket, err)
+		}
+		return this.processPlayers(full, compressed)
+	default:
+		return nil, ErrBadPacketHeader
+	}
+}
+
+// Issue a challenge-based query (A2S_RULES or A2S_PLAYER), retrying if the
+// server replies with the wrong kind of packet. On success, the first packet
+// of the reply is returned.
+func (this *ServerQuerier) challengeQuery(ctx context.Context, query uint8, reply uint8) ([]byte, error) {
+	// Try to get a successful challenge.
+	rechallenges := 0
+	data, err := this.a2s_challenge(ctx, query, reply)
+	for errors.Is(err, ErrConfusedChallengeReply) && rechallenges < 3 {
+		data, err = this.a2s_challenge(ctx, query, reply)
+		rechallenges++
+	}
+
+	// Challenge failed - abort.
 	if err != nil {
 		return nil, err
 	}
+	return data, nil
+}
+
+func (this *ServerQuerier) a2s_challenge(ctx context.Context, query uint8, reply uint8) ([]byte, error) {
+	data := []byte{
+		0xff, 0xff, 0xff, 0xff,
+		query,
+		0xff, 0xff, 0xff, 0xff,
+	}
+	data, _, err := this.exchange(ctx, data)
+	if err != nil {
+		return nil, newQueryError(Phase_Challenge, err)
+	}
 
-	switch int32(binary.LittleEndian.Uint32(data[0:4])) {
+	switch packetHeader(data) {
 	case -2:
 		// AgeOfChivalry (appid 17510 had an instance of immediately reporting
 		// a rules reply in response to a challenge. Maybe in a rare case the
@@ -362,34 +432,54 @@ func (this *ServerQuerier) a2s_rules() ([]byte, error) {
 	case -1:
 		// Ok, continue.
 	default:
-		panic(ErrBadPacketHeader)
+		return nil, newQueryError(Phase_Challenge, ErrBadPacketHeader)
+	}
+	if len(data) < 5 {
+		return nil, newQueryError(Phase_Challenge, ErrBadPacketHeader)
 	}
 
 	switch data[4] {
-	case S2A_RULES:
+	case reply:
 		// Some servers report an immediate, very truncated A2S_RULES reply.
 		// It's not clear why - either a bug or some sort of information
 		// hiding tactic, but we support this anyway.
 		return data, nil
-	case S2A_INFO_SOURCE, S2A_PLAYER:
+	case S2A_INFO_SOURCE, S2A_PLAYER, S2A_RULES:
 		// Some servers reply with the wrong kind of query. For these, we retry.
-		return nil, ErrConfusedChallengeReply
+		return nil, newQueryError(Phase_Challenge, ErrConfusedChallengeReply)
 	case S2C_CHALLENGE:
 		// Ok, continue.
 	default:
-		panic(ErrBadChallengeResponse)
+		return nil, newQueryError(Phase_Challenge, ErrBadChallengeResponse)
+	}
+	if len(data) < 9 {
+		return nil, newQueryError(Phase_Challenge, ErrBadChallengeResponse)
 	}
 
-	// Send the rules query now that we've got a challenge sequence.
-	reply := []byte{
+	// Send the query now that we've got a challenge sequence.
+	request := []byte{
 		0xff, 0xff, 0xff, 0xff,
-		A2S_RULES,
+		query,
 		data[5], data[6], data[7], data[8],
 	}
-	if err := this.socket.Send(reply); err != nil {
-		return nil, err
+	data, _, err = this.exchange(ctx, request, reply)
+	if err != nil {
+		phase := Phase_Rules
+		if query == A2S_PLAYER {
+			phase = Phase_Players
+		}
+		return nil, newQueryError(phase, err)
 	}
-	return this.socket.Recv()
+	return data, nil
+}
+
+// Returns the header of an OOB packet: -1 for a single packet, or -2 for a
+// split packet. Packets too short to have a header return 0.
+func packetHeader(data []byte) int32 {
+	if len(data) < 4 {
+		return 0
+	}
+	return int32(binary.LittleEndian.Uint32(data))
 }
 
 type MultiPacketHeader struct {
@@ -414,13 +504,13 @@ type MultiPacketHeader struct {
 	Payload []byte
 }
 
-func (this *ServerQuerier) decodeMultiPacketHeader(data []byte) *MultiPacketHeader {
+func (this *ServerQuerier) decodeMultiPacketHeader(data []byte) (*MultiPacketHeader, error) {
 	reader := NewPacketReader(data)
 	if reader.ReadInt32() != -2 {
-		panic(ErrBadPacketHeader)
+		return nil, ErrBadPacketHeader
 	}
 	if this.info == nil {
-		panic(ErrUnknownGameEngine)
+		return nil, ErrUnknownGameEngine
 	}
 
 	header := &MultiPacketHeader{}
@@ -441,26 +531,33 @@ func (this *ServerQuerier) decodeMultiPacketHeader(data []byte) *MultiPacketHead
 		}
 
 	default:
-		panic(ErrUnknownGameEngine)
+		return nil, ErrUnknownGameEngine
+	}
+
+	if err := reader.Err(); err != nil {
+		return nil, err
 	}
 
 	header.Size = reader.Pos()
 	header.Payload = data[header.Size:]
-	return header
+	return header, nil
 }
 
-func (this *ServerQuerier) waitForMultiPacketReply(data []byte) ([]byte, bool, error) {
-	header := this.decodeMultiPacketHeader(data)
+func (this *ServerQuerier) waitForMultiPacketReply(ctx context.Context, data []byte) ([]byte, bool, error) {
+	header, err := this.decodeMultiPacketHeader(data)
+	if err != nil {
+		return nil, false, err
+	}
 	packets := make([]*MultiPacketHeader, header.TotalPackets)
 	received := 0
 	fullSize := 0
 
 	for {
 		if int(header.PacketNumber) >= len(packets) {
-			panic(ErrBadPacketNumber)
+			return nil, false, ErrBadPacketNumber
 		}
 		if packets[header.PacketNumber] != nil {
-			panic(ErrDuplicatePacket)
+			return nil, false, ErrDuplicatePacket
 		}
 
 		packets[header.PacketNumber] = header
@@ -471,12 +568,15 @@ func (this *ServerQuerier) waitForMultiPacketReply(data []byte) ([]byte, bool, e
 			break
 		}
 
-		data, err := this.socket.Recv()
+		data, err := this.socket.RecvContext(ctx)
 		if err != nil {
 			return nil, false, err
 		}
 
-		header = this.decodeMultiPacketHeader(data)
+		header, err = this.decodeMultiPacketHeader(data)
+		if err != nil {
+			return nil, false, err
+		}
 	}
 
 	payload := make([]byte, fullSize)
@@ -489,44 +589,58 @@ func (this *ServerQuerier) waitForMultiPacketReply(data []byte) ([]byte, bool, e
 	return payload, packets[0].Compressed, nil
 }
 
-func (this *ServerQuerier) processRules(data []byte, compressed bool) (map[string]string, error) {
+// Decompress a bzip2-compressed multi-packet payload.
+func decompressPayload(data []byte) ([]byte, error) {
 	reader := NewPacketReader(data)
+	decompressedSize := reader.ReadUint32()
+	checksum := reader.ReadUint32()
+	if err := reader.Err(); err != nil {
+		return nil, err
+	}
 
-	if compressed {
-		decompressedSize := reader.ReadUint32()
-		checksum := reader.ReadUint32()
+	// Sanity check so we don't allocate and zero 3GB of memory by accident.
+	if decompressedSize > uint32(1024*1024) {
+		return nil, ErrWrongBz2Size
+	}
 
-		// Sanity check so we don't allocate and zero 3GB of memory by accident.
-		if decompressedSize > uint32(1024*1024) {
-			return nil, ErrWrongBz2Size
-		}
+	decompressed := make([]byte, decompressedSize)
+	bz2Reader := bzip2.NewReader(bytes.NewReader(data[reader.Pos():]))
+	n, err := bz2Reader.Read(decompressed)
+	if err != nil {
+		return nil, err
+	}
+	if n != int(decompressedSize) {
+		return nil, ErrWrongBz2Size
+	}
+	if crc32.ChecksumIEEE(decompressed) != checksum {
+		return nil, ErrWrongBz2Checksum
+	}
+	return decompressed, nil
+}
 
-		decompressed := make([]byte, decompressedSize)
-		bz2Reader := bzip2.NewReader(bytes.NewReader(data[reader.Pos():]))
-		n, err := bz2Reader.Read(decompressed)
+func (this *ServerQuerier) processRules(data []byte, compressed bool) (map[string]string, error) {
+	if compressed {
+		decompressed, err := decompressPayload(data)
 		if err != nil {
-			return nil, err
-		}
-		if n != int(decompressedSize) {
-			return nil, ErrWrongBz2Size
-		}
-		if crc32.ChecksumIEEE(decompressed) != checksum {
-			return nil, ErrWrongBz2Checksum
+			return nil, newQueryError(Phase_Decompress, err)
 		}
 
 		// Switch to the decompressed stream.
 		data = decompressed
-		reader = NewPacketReader(data)
 	}
 
+	reader := NewPacketReader(data)
 	if reader.ReadInt32() != -1 {
-		panic(ErrBadPacketHeader)
+		return nil, ErrBadPacketHeader
 	}
 	if reader.ReadUint8() != S2A_RULES {
-		panic(ErrBadRulesReply)
+		return nil, ErrBadRulesReply
 	}
 
 	count := int(reader.ReadUint16())
+	if err := reader.Err(); err != nil {
+		return nil, err
+	}
 
 	rules := map[string]string{}
 	for i := 0; i < count; i++ {
@@ -543,3 +657,62 @@ func (this *ServerQuerier) processRules(data []byte, compressed bool) (map[strin
 
 	return rules, nil
 }
+
+func (this *ServerQuerier) processPlayers(data []byte, compressed bool) ([]*PlayerInfo, error) {
+	if compressed {
+		decompressed, err := decompressPayload(data)
+		if err != nil {
+			return nil, newQueryError(Phase_Decompress, err)
+		}
+		data = decompressed
+	}
+
+	reader := NewPacketReader(data)
+	if reader.ReadInt32() != -1 {
+		return nil, ErrBadPacketHeader
+	}
+	if reader.ReadUint8() != S2A_PLAYER {
+		return nil, ErrBadPlayersReply
+	}
+
+	count := int(reader.ReadUint8())
+	if err := reader.Err(); err != nil {
+		return nil, err
+	}
+
+	// The player count is often wrong (for example, it may include bots or
+	// players that have not finished connecting), so we stop at whatever is
+	// actually in the packet.
+	players := []*PlayerInfo{}
+	for i := 0; i < count; i++ {
+		if reader.Remaining() < 1 {
+			break
+		}
+		index := reader.ReadUint8()
+		name, ok := reader.TryReadString()
+		if !ok || reader.Remaining() < 8 {
+			break
+		}
+		players = append(players, &PlayerInfo{
+			Index:    index,
+			Name:     name,
+			Score:    reader.ReadInt32(),
+			Duration: reader.ReadFloat32(),
+		})
+	}
+
+	// The Ship appends deaths and money for each player.
+	if this.info != nil && this.info.TheShip != nil {
+		for _, player := range players {
+			if reader.Remaining() < 8 {
+				break
+			}
+			player.TheShip = &TheShipPlayerInfo{
+				Deaths: reader.ReadUint32(),
+				Money:  reader.ReadUint32(),
+			}
+		}
+	}
+
+	return players, nil
+}
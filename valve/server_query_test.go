@@ -0,0 +1,194 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// The seed corpus below is not captured from real servers. It is built by hand
+// from the reply formats documented at
+// https://developer.valvesoftware.com/wiki/Server_queries, so it only covers
+// the quirks we know about. Captured replies can be added to the corpus as
+// files under testdata/fuzz/<FuzzTarget>/, in the format written by
+// "go test -fuzz".
+
+func seedPacket(parts ...interface{}) []byte {
+	var packet PacketBuilder
+	for _, part := range parts {
+		switch part := part.(type) {
+		case string:
+			packet.WriteCString(part)
+		case []byte:
+			packet.WriteBytes(part)
+		default:
+			binary.Write(&packet, binary.LittleEndian, part)
+		}
+	}
+	return packet.Bytes()
+}
+
+var kOOBHeader = []byte{0xff, 0xff, 0xff, 0xff}
+var kSplitHeader = []byte{0xfe, 0xff, 0xff, 0xff}
+
+// A Counter-Strike: Source reply with every EDF field.
+var kSeedSourceInfo = seedPacket(
+	kOOBHeader, S2A_INFO_SOURCE, uint8(17),
+	"AlliedModders Test", "de_dust2", "cstrike", "Counter-Strike: Source",
+	uint16(240), uint8(12), uint8(24), uint8(2), []byte("dl"), uint8(0), uint8(1),
+	"7608765",
+	uint8(0xf1), uint16(27015), uint64(90091830459546624),
+	uint16(27020), "SourceTV",
+	"alltalk,increased_maxplayers",
+	uint64(240),
+)
+
+// A Counter-Strike 1.6 reply with mod information.
+var kSeedGoldSrcInfo = seedPacket(
+	kOOBHeader, S2A_INFO_GOLDSRC,
+	"127.0.0.1:27015", "HLDS Test", "de_inferno", "cstrike", "Counter-Strike",
+	uint8(5), uint8(32), uint8(48), []byte("dl"), uint8(0),
+	uint8(1), "http://example.com", "http://example.com/dl", uint8(0),
+	uint32(1), uint32(184000000), uint8(0), uint8(1),
+	uint8(1), uint8(0),
+)
+
+// A reply from The Ship, which has extra fields before the version.
+var kSeedTheShipInfo = seedPacket(
+	kOOBHeader, S2A_INFO_SOURCE, uint8(7),
+	"Ship Test", "batavier", "ship", "The Ship",
+	uint16(2400), uint8(4), uint8(16), uint8(0), []byte("dw"), uint8(0), uint8(1),
+	uint8(0), uint8(2), uint8(3),
+	"1.0.0.16",
+)
+
+// A pre-Orange Box Source reply (CS:S protocol 7) with no EDF.
+var kSeedPreOrangeBoxInfo = seedPacket(
+	kOOBHeader, S2A_INFO_SOURCE, uint8(7),
+	"Old CSS", "cs_office", "cstrike", "Counter-Strike: Source",
+	uint16(240), uint8(3), uint8(16), uint8(0), []byte("dw"), uint8(0), uint8(1),
+	"1.0.0.34",
+)
+
+var kSeedRules = seedPacket(
+	kOOBHeader, S2A_RULES, uint16(3),
+	"mp_friendlyfire", "0",
+	"sm_nextmap", "de_nuke",
+	"sourcemod_version", "1.11.0.6911",
+)
+
+// The rules "sv_cheats 0" and "mp_timelimit 30", compressed as a split reply
+// payload: decompressed size, CRC32, then bzip2 data.
+var kSeedCompressedRules, _ = hex.DecodeString(
+	"23000000f0ea1055425a68393141592653595b42683d000011cf80d000480002000000aa664d00" +
+		"0000a0002221a68069a7ea8534c8c4c4c4ec0cd3bdaf3407df48716c2695a8b8024df1772453" +
+		"850905b42683d0")
+
+var kSeedPlayers = seedPacket(
+	kOOBHeader, S2A_PLAYER, uint8(2),
+	uint8(0), "Player", int32(14), float32(1234.5),
+	uint8(1), "(1)Player", int32(-2), float32(30.25),
+)
+
+// The Ship appends deaths and money for each player.
+var kSeedTheShipPlayers = seedPacket(
+	kOOBHeader, S2A_PLAYER, uint8(1),
+	uint8(0), "Sailor", int32(3), float32(600),
+	uint32(1), uint32(5000),
+)
+
+func newFuzzQuerier(engine uint8) *ServerQuerier {
+	info := &ServerInfo{}
+	switch engine % 4 {
+	case 0:
+		info.InfoVersion = S2A_INFO_GOLDSRC
+	case 1:
+		info.InfoVersion = S2A_INFO_SOURCE
+		info.Ext = &ExtendedInfo{AppId: App_TF2}
+	case 2:
+		info.InfoVersion = S2A_INFO_SOURCE
+		info.Protocol = 7
+		info.Ext = &ExtendedInfo{AppId: App_CSS}
+	case 3:
+		info.InfoVersion = S2A_INFO_SOURCE
+		info.Ext = &ExtendedInfo{AppId: App_TheShip}
+		info.TheShip = &TheShipInfo{}
+	}
+	return &ServerQuerier{info: info}
+}
+
+func FuzzParseInfoReply(f *testing.F) {
+	f.Add(kSeedSourceInfo)
+	f.Add(kSeedGoldSrcInfo)
+	f.Add(kSeedTheShipInfo)
+	f.Add(kSeedPreOrangeBoxInfo)
+	f.Add(kSeedPlayers)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		querier := &ServerQuerier{}
+		info := &ServerInfo{}
+		if querier.parse_a2s_info_reply(info, data) != nil {
+			return
+		}
+
+		// A successful parse must produce an engine we can split packets for.
+		switch info.GameEngine() {
+		case GOLDSRC, SOURCE:
+		default:
+			t.Errorf("unknown engine for %+v", info)
+		}
+	})
+}
+
+func FuzzProcessRules(f *testing.F) {
+	f.Add(kSeedRules, false)
+	f.Add(kSeedCompressedRules, true)
+
+	f.Fuzz(func(t *testing.T, data []byte, compressed bool) {
+		querier := &ServerQuerier{}
+		rules, err := querier.processRules(data, compressed)
+		if err == nil && rules == nil {
+			t.Errorf("nil rules without an error")
+		}
+	})
+}
+
+func FuzzProcessPlayers(f *testing.F) {
+	f.Add(kSeedPlayers, uint8(1))
+	f.Add(kSeedTheShipPlayers, uint8(3))
+
+	f.Fuzz(func(t *testing.T, data []byte, engine uint8) {
+		querier := newFuzzQuerier(engine)
+		players, err := querier.processPlayers(data, false)
+		if err == nil && len(players) > 255 {
+			t.Errorf("too many players: %d", len(players))
+		}
+	})
+}
+
+func FuzzDecodeMultiPacketHeader(f *testing.F) {
+	// GoldSrc: packet 0 of 2.
+	f.Add(seedPacket(kSplitHeader, uint32(1), uint8(0x02), kSeedRules), uint8(0))
+	// Source: packet 0 of 2, with a size.
+	f.Add(seedPacket(kSplitHeader, uint32(2), uint8(2), uint8(0), uint16(1248), kSeedRules), uint8(1))
+	// Pre-Orange Box: no size.
+	f.Add(seedPacket(kSplitHeader, uint32(3), uint8(2), uint8(1), kSeedRules), uint8(2))
+	// Compressed.
+	f.Add(seedPacket(kSplitHeader, uint32(0x80000004), uint8(1), uint8(0), uint16(1248), kSeedCompressedRules), uint8(1))
+
+	f.Fuzz(func(t *testing.T, data []byte, engine uint8) {
+		querier := newFuzzQuerier(engine)
+		header, err := querier.decodeMultiPacketHeader(data)
+		if err != nil {
+			return
+		}
+		if header.Size+len(header.Payload) != len(data) {
+			t.Errorf("header size %d + payload %d != packet %d", header.Size, len(header.Payload), len(data))
+		}
+	})
+}
@@ -0,0 +1,116 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// A Partition is a list of filters that split a master query into disjoint
+// parts, which together match every server the original query would.
+type Partition []Filter
+
+var (
+	// Empty and non-empty servers.
+	PartitionEmpty = Partition{FilterNoPlayers(), FilterNotEmpty()}
+
+	// Dedicated and non-dedicated servers.
+	PartitionDedicated = Partition{FilterDedicated(), FilterNor(FilterDedicated())}
+
+	// Secure and insecure servers.
+	PartitionSecure = Partition{FilterSecure(), FilterNor(FilterSecure())}
+
+	// Linux and non-Linux servers.
+	PartitionLinux = Partition{FilterLinux(), FilterNor(FilterLinux())}
+)
+
+var kPartitionNames = map[string]Partition{
+	"empty":     PartitionEmpty,
+	"dedicated": PartitionDedicated,
+	"secure":    PartitionSecure,
+	"linux":     PartitionLinux,
+}
+
+// Parses a partition name ("empty", "dedicated", "secure", or "linux").
+func ParsePartition(name string) (Partition, error) {
+	if partition, ok := kPartitionNames[name]; ok {
+		return partition, nil
+	}
+	return nil, fmt.Errorf("unknown partition: %s", name)
+}
+
+// Sets the partitions used to shard queries. Sharding splits a query into
+// several smaller ones, using each partition in turn, so the master is less
+// likely to time out partway through a large result set.
+//
+// If |always| is true, every query is split up front by every partition.
+// Otherwise, a query is only split (by the next partition) if the master
+// stops replying partway through it, which is only detected once replies time
+// out (see SetTimeout()). Results are deduplicated either way.
+func (this *MasterServerQuerier) SetPartitions(always bool, partitions ...Partition) {
+	this.partitions = partitions
+	this.alwaysShard = always
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Query a single filter string, sharding it by the given partitions.
+func (this *MasterServerQuerier) queryShards(
+	ctx context.Context,
+	callback MasterQueryCallback,
+	region Region,
+	filter string,
+	partitions []Partition,
+	seen map[string]bool,
+) error {
+	seed := kInitialSeed
+	resuming := this.resume != nil
+	if resuming && this.resume.Filter == filter {
+		// This is the exact query we stopped in.
+		seed = this.resume.Seed
+		this.resume = nil
+		resuming = false
+	}
+	if resuming && len(partitions) == 0 {
+		return ErrBadCheckpoint
+	}
+
+	if !resuming && (!this.alwaysShard || len(partitions) == 0) {
+		err := this.tryQuery(ctx, callback, region, []string{filter}, seen, seed)
+		if err == nil || len(partitions) == 0 || !isTimeout(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	for _, part := range partitions[0] {
+		shard := filter + part.String()
+		if len(shard) > kMaxFilterLength {
+			return ErrFilterTooLong
+		}
+
+		// Skip shards that were completed before the checkpoint.
+		if this.resume != nil && !strings.HasPrefix(this.resume.Filter, shard) {
+			continue
+		}
+
+		if err := this.queryShards(ctx, callback, region, shard, partitions[1:], seen); err != nil {
+			return err
+		}
+	}
+
+	// If we were resuming, one of the shards must have matched.
+	if this.resume != nil {
+		return ErrBadCheckpoint
+	}
+	return nil
+}
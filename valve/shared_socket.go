@@ -0,0 +1,229 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrAddressInUse = errors.New("address already has an open shared socket")
+var ErrSocketClosed = errors.New("shared socket is closed")
+
+// Number of packets we buffer for each remote address before dropping them.
+// This is enough for a large multi-packet reply.
+const kSharedQueueLength = 32
+
+// The longest we wait between reads when a socket keeps returning errors.
+const kSharedMaxReadBackoff = time.Second
+
+// A SharedUdpSocket sends and receives packets for many remote addresses over
+// a small number of unconnected UDP sockets. Replies are routed back to the
+// right QuerySocket by their source address, so thousands of servers can be
+// queried at once without opening a socket for each one.
+type SharedUdpSocket struct {
+	conns []net.PacketConn
+
+	lock   sync.Mutex
+	routes map[string]*sharedConn
+	next   int
+	closed bool
+}
+
+// Create a new shared socket, backed by |count| UDP sockets.
+func NewSharedUdpSocket(count int) (*SharedUdpSocket, error) {
+	if count < 1 {
+		count = 1
+	}
+
+	this := &SharedUdpSocket{
+		routes: map[string]*sharedConn{},
+	}
+	for i := 0; i < count; i++ {
+		cn, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			this.Close()
+			return nil, err
+		}
+		this.conns = append(this.conns, cn)
+	}
+
+	for _, cn := range this.conns {
+		go this.readPackets(cn)
+	}
+	return this, nil
+}
+
+// Open a QuerySocket to the given address. Only one may be open for each
+// address at a time.
+func (this *SharedUdpSocket) Dial(address string, timeout time.Duration) (QuerySocket, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, newQueryError(Phase_Dial, err)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return nil, newQueryError(Phase_Dial, ErrSocketClosed)
+	}
+
+	key := addr.String()
+	if _, found := this.routes[key]; found {
+		return nil, newQueryError(Phase_Dial, ErrAddressInUse)
+	}
+
+	conn := &sharedConn{
+		owner:   this,
+		cn:      this.conns[this.next%len(this.conns)],
+		addr:    addr,
+		key:     key,
+		timeout: timeout,
+		packets: make(chan []byte, kSharedQueueLength),
+	}
+	this.next++
+
+	this.routes[key] = conn
+	return conn, nil
+}
+
+// Close all underlying sockets. Any open QuerySockets will fail to send, and
+// time out when receiving.
+func (this *SharedUdpSocket) Close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.closed = true
+	for _, cn := range this.conns {
+		cn.Close()
+	}
+}
+
+func (this *SharedUdpSocket) unroute(conn *sharedConn) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.routes[conn.key] == conn {
+		delete(this.routes, conn.key)
+	}
+}
+
+func nextReadBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return time.Millisecond
+	}
+	if backoff*2 > kSharedMaxReadBackoff {
+		return kSharedMaxReadBackoff
+	}
+	return backoff * 2
+}
+
+// This runs in its own goroutine for each underlying socket.
+func (this *SharedUdpSocket) readPackets(cn net.PacketConn) {
+	var buffer [kMaxPacketSize]byte
+	var backoff time.Duration
+	for {
+		n, addr, err := cn.ReadFrom(buffer[:])
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// Some errors are harmless, such as Windows reporting an ICMP
+			// error for an earlier send, so we keep reading. If the errors
+			// don't stop, we back off rather than spin.
+			time.Sleep(backoff)
+			backoff = nextReadBackoff(backoff)
+			continue
+		}
+		backoff = 0
+
+		this.lock.Lock()
+		conn, found := this.routes[addr.String()]
+		this.lock.Unlock()
+
+		// Drop packets from addresses we're not querying. If the address has
+		// been closed and dialed again, a late reply for the old route can
+		// arrive on its socket, or before the new route has sent anything,
+		// and is dropped too.
+		if !found || conn.cn != cn || atomic.LoadInt32(&conn.sent) == 0 {
+			continue
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buffer[:n])
+
+		// Drop the packet if nothing is receiving; UDP is lossy anyway.
+		select {
+		case conn.packets <- packet:
+		default:
+		}
+	}
+}
+
+// A QuerySocket backed by a SharedUdpSocket.
+type sharedConn struct {
+	owner   *SharedUdpSocket
+	cn      net.PacketConn
+	addr    *net.UDPAddr
+	key     string
+	timeout time.Duration
+	packets chan []byte
+
+	// Set once a packet has been sent.
+	sent int32
+}
+
+func (this *sharedConn) SendContext(ctx context.Context, bytes []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&this.sent, 1)
+	_, err := this.cn.WriteTo(bytes, this.addr)
+	return err
+}
+
+func (this *sharedConn) RecvContext(ctx context.Context) ([]byte, error) {
+	var timeout <-chan time.Time
+	if this.timeout > 0 {
+		timer := time.NewTimer(this.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-this.packets:
+		return packet, nil
+	case <-timeout:
+		return nil, &net.OpError{
+			Op:     "read",
+			Net:    "udp",
+			Source: this.cn.LocalAddr(),
+			Addr:   this.addr,
+			Err:    os.ErrDeadlineExceeded,
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (this *sharedConn) SetTimeout(timeout time.Duration) {
+	this.timeout = timeout
+}
+
+func (this *sharedConn) RemoteAddr() net.Addr {
+	return this.addr
+}
+
+func (this *sharedConn) Close() {
+	this.owner.unroute(this)
+}
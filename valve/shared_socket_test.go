@@ -0,0 +1,70 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSharedSocketReplacedRoute(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	shared, err := NewSharedUdpSocket(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shared.Close()
+
+	// Send a request, then close the socket without waiting for the reply.
+	old, err := shared.Dial(server.LocalAddr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.SendContext(context.Background(), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	var buffer [16]byte
+	_, client, err := server.ReadFrom(buffer[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	// The late reply must not reach a new socket to the same address.
+	current, err := shared.Dial(server.LocalAddr().String(), time.Millisecond*100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.Close()
+	server.WriteTo([]byte("old"), client)
+	if packet, err := current.RecvContext(context.Background()); err == nil {
+		t.Fatalf("received %q from a closed socket", packet)
+	}
+
+	// Replies to the new socket still arrive.
+	if err := current.SendContext(context.Background(), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, client, err = server.ReadFrom(buffer[:]); err != nil {
+		t.Fatal(err)
+	}
+	server.WriteTo([]byte("new"), client)
+	packet, err := current.RecvContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet, []byte("new")) {
+		t.Errorf("expected %q, got %q", "new", packet)
+	}
+}
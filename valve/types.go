@@ -7,6 +7,7 @@ package valve
 
 import (
 	"net"
+	"time"
 )
 
 // A list of IP addresses and ports.
@@ -80,6 +81,7 @@ func (this ServerOS) String() string {
 
 // OOB request packet types.
 const A2S_INFO uint8 = 0x54
+const A2S_PLAYER uint8 = 0x55
 const A2S_RULES uint8 = 0x56
 
 // Official versions of the A2S_INFO reply.
@@ -108,6 +110,23 @@ type TheShipInfo struct {
 	Duration  uint8 `json:"duration"`
 }
 
+// Optional per-player information returned by App_TheShip.
+type TheShipPlayerInfo struct {
+	Deaths uint32 `json:"deaths"`
+	Money  uint32 `json:"money"`
+}
+
+// Information about a single player, returned by an A2S_PLAYER query.
+type PlayerInfo struct {
+	Index    uint8   `json:"index"`
+	Name     string  `json:"name"`
+	Score    int32   `json:"score"`
+	Duration float32 `json:"duration"` // Seconds connected.
+
+	// Only available from The Ship.
+	TheShip *TheShipPlayerInfo `json:"theship,omitempty"`
+}
+
 // Optional information available with S2A_INFO_SOURCE.
 type SpecTvInfo struct {
 	Port uint16
@@ -153,6 +172,13 @@ type ServerInfo struct {
 	TheShip    *TheShipInfo
 	SpecTv     *SpecTvInfo
 	Ext        *ExtendedInfo
+
+	// The round-trip time of the A2S_INFO exchange, measured by ServerQuerier.
+	// If the server required a challenge, Ping measures only the final
+	// exchange, and ChallengePing measures the challenge round trip. Otherwise
+	// ChallengePing is 0.
+	Ping          time.Duration
+	ChallengePing time.Duration
 }
 
 // Attempt to guess the game engine version.
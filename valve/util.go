@@ -18,7 +18,7 @@ func tryAndCatch(fn func() error) error {
 				if !ok {
 					err = fmt.Errorf("%v", r)
 				}
-				outErr = err
+				outErr = &panicError{err: err}
 			}
 		}()
 
@@ -31,5 +31,6 @@ func tryNoCatch(fn func() error) error {
 	return fn()
 }
 
-// This can be changed to enable panics.
+// Malformed packets are reported as errors rather than panics, so this is
+// only a safety net. It can be changed to tryNoCatch to enable panics.
 var Try = tryAndCatch
@@ -0,0 +1,22 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valvetest
+
+import (
+	"github.com/alliedmodders/blaster/valve/fakemaster"
+)
+
+// A FakeMaster is a local UDP server that answers Master Server Query
+// Protocol requests for a fixed list of servers. See the fakemaster package.
+type FakeMaster = fakemaster.Master
+
+// A server listed by a FakeMaster.
+type MasterEntry = fakemaster.Entry
+
+// Create a new fake master server, which is not yet listening.
+func NewFakeMaster(servers []*MasterEntry) *FakeMaster {
+	return fakemaster.NewMaster(servers)
+}
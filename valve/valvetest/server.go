@@ -0,0 +1,181 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+
+// Package valvetest provides local emulations of Valve servers, so that code
+// using the valve package can be tested without a network.
+package valvetest
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alliedmodders/blaster/valve"
+)
+
+// A FakeServer is a local UDP server that answers A2S_INFO, A2S_RULES, and
+// A2S_PLAYER queries like a GoldSrc or Source game server, including the
+// quirks that ServerQuerier has to handle. Well-behaved replies come from a
+// valve.Responder. Configure it before calling
+// Start(); fields must not be changed while it is running.
+type FakeServer struct {
+	// The reply to A2S_INFO. Its InfoVersion decides whether the server
+	// behaves like GoldSrc or Source, including the split packet format.
+	Info *valve.ServerInfo
+
+	Rules   map[string]string
+	Players []*valve.PlayerInfo
+
+	// Require a challenge for A2S_INFO, as newer Source servers do.
+	ChallengeInfo bool
+
+	// Split replies with payloads larger than this many bytes. Defaults to
+	// the size used by Source servers.
+	SplitSize int
+
+	// Compress split replies with bzip2. This only applies to Source servers
+	// that are not pre-Orange Box.
+	Compress bool
+
+	// Follow each A2S_INFO reply with an S2A_PLAYER packet and a second,
+	// Source-format info reply, as Half-Life 1 servers often do.
+	ExtraInfoPackets bool
+
+	// Reply to this many challenge requests (for A2S_RULES or A2S_PLAYER)
+	// with the wrong kind of packet before replying correctly.
+	ConfusedChallenges int
+
+	// Wait this long before sending each reply, to simulate network latency.
+	// Replies are delayed independently, so requests sent while waiting are
+	// not held up.
+	Latency time.Duration
+
+	// If set, requests for which this returns true are ignored, to simulate
+	// packet loss. Requests are numbered from 1.
+	Drop func(request int) bool
+
+	conn      net.PacketConn
+	responder *valve.Responder
+	lock      sync.Mutex
+	confused  int
+	requests  int
+	done      chan bool
+}
+
+// Create a new fake server, which is not yet listening.
+func NewFakeServer(info *valve.ServerInfo) *FakeServer {
+	return &FakeServer{
+		Info:  info,
+		Rules: map[string]string{},
+	}
+}
+
+// Start listening on a random local port.
+func (this *FakeServer) Start() error {
+	responder, err := valve.NewResponder(this.Info)
+	if err != nil {
+		return err
+	}
+	responder.SetRules(this.Rules)
+	responder.SetPlayers(this.Players)
+	responder.SetChallengeInfo(this.ChallengeInfo)
+	responder.SetCompression(this.Compress)
+	if this.SplitSize > 0 {
+		responder.SetSplitSize(this.SplitSize)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	this.conn = conn
+	this.responder = responder
+	this.done = make(chan bool)
+	go this.serve()
+	return nil
+}
+
+// The address the server is listening on.
+func (this *FakeServer) Addr() string {
+	return this.conn.LocalAddr().String()
+}
+
+// Number of packets received so far.
+func (this *FakeServer) Requests() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.requests
+}
+
+// Stop the server and wait for it to exit.
+func (this *FakeServer) Close() {
+	this.conn.Close()
+	<-this.done
+}
+
+func (this *FakeServer) serve() {
+	defer close(this.done)
+
+	buffer := make([]byte, 1400)
+	for {
+		n, addr, err := this.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+
+		this.lock.Lock()
+		this.requests++
+		var replies [][]byte
+		if this.Drop == nil || !this.Drop(this.requests) {
+			replies = this.handle(buffer[:n], addr)
+		}
+		this.lock.Unlock()
+
+		if len(replies) == 0 {
+			continue
+		}
+		if this.Latency > 0 {
+			time.AfterFunc(this.Latency, func() {
+				this.send(replies, addr)
+			})
+		} else {
+			this.send(replies, addr)
+		}
+	}
+}
+
+func (this *FakeServer) send(replies [][]byte, addr net.Addr) {
+	for _, reply := range replies {
+		this.conn.WriteTo(reply, addr)
+	}
+}
+
+// Returns the packets to send in reply to a request, or nil to ignore it.
+func (this *FakeServer) handle(request []byte, addr net.Addr) [][]byte {
+	if len(request) >= 5 && binary.LittleEndian.Uint32(request) == 0xffffffff {
+		switch request[4] {
+		case valve.A2S_RULES, valve.A2S_PLAYER:
+			if this.confused < this.ConfusedChallenges && !this.hasChallenge(request[5:], addr) {
+				this.confused++
+				return [][]byte{valve.EncodeSourceInfoReply(this.Info)}
+			}
+		}
+	}
+
+	replies := this.responder.HandlePacket(request, addr)
+	if this.ExtraInfoPackets && len(replies) == 1 && replies[0][4] == valve.S2A_INFO_GOLDSRC {
+		replies = append(replies,
+			valve.EncodePlayersReply(this.Players, this.Info.TheShip != nil),
+			valve.EncodeSourceInfoReply(this.Info))
+	}
+	return replies
+}
+
+func (this *FakeServer) hasChallenge(data []byte, addr net.Addr) bool {
+	return len(data) >= 4 && binary.LittleEndian.Uint32(data) == this.responder.Challenge(addr)
+}
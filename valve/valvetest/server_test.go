@@ -0,0 +1,430 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valvetest
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alliedmodders/blaster/valve"
+)
+
+const kTimeout = time.Second * 2
+
+func sourceInfo(appId valve.AppId, protocol uint8) *valve.ServerInfo {
+	return &valve.ServerInfo{
+		InfoVersion: valve.S2A_INFO_SOURCE,
+		Protocol:    protocol,
+		Name:        "Fake Source Server",
+		MapName:     "de_dust2",
+		Folder:      "cstrike",
+		Game:        "Counter-Strike: Source",
+		Players:     3,
+		MaxPlayers:  24,
+		Bots:        1,
+		Type:        valve.ServerType_Dedicated,
+		OS:          valve.ServerOS_Linux,
+		Vac:         1,
+		SpecTv: &valve.SpecTvInfo{
+			Port: 27020,
+			Name: "SourceTV",
+		},
+		Ext: &valve.ExtendedInfo{
+			AppId:               appId,
+			GameVersion:         "1.0.0.70",
+			Port:                27015,
+			SteamId:             90091830459546624,
+			GameModeDescription: "alltalk",
+			GameId:              uint64(appId),
+		},
+	}
+}
+
+func goldSrcInfo() *valve.ServerInfo {
+	return &valve.ServerInfo{
+		Address:     "127.0.0.1:27015",
+		InfoVersion: valve.S2A_INFO_GOLDSRC,
+		Protocol:    48,
+		Name:        "Fake HLDS Server",
+		MapName:     "de_inferno",
+		Folder:      "cstrike",
+		Game:        "Counter-Strike",
+		Players:     5,
+		MaxPlayers:  32,
+		Type:        valve.ServerType_Dedicated,
+		OS:          valve.ServerOS_Windows,
+		Vac:         1,
+		Mod: &valve.ModInfo{
+			Url:     "http://example.com",
+			DwlUrl:  "http://example.com/dl",
+			Version: 1,
+			Size:    184000000,
+			Dll:     1,
+		},
+	}
+}
+
+// Enough rules to need several packets.
+func manyRules() map[string]string {
+	rules := map[string]string{}
+	for i := 0; i < 300; i++ {
+		rules[fmt.Sprintf("sm_plugin_cvar_%d", i)] = fmt.Sprintf("value %d", i)
+	}
+	return rules
+}
+
+func startServer(t *testing.T, server *FakeServer) *valve.ServerQuerier {
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	query, err := valve.NewServerQuerier(server.Addr(), kTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(query.Close)
+	return query
+}
+
+func TestSourceInfo(t *testing.T) {
+	server := NewFakeServer(sourceInfo(valve.App_CSS, 17))
+	server.ChallengeInfo = true
+	query := startServer(t, server)
+
+	info, err := query.QueryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Ping <= 0 || info.ChallengePing <= 0 {
+		t.Errorf("expected both round trips to be measured, got %v and %v", info.Ping, info.ChallengePing)
+	}
+	info.Ping, info.ChallengePing = 0, 0
+
+	expected := *server.Info
+	expected.Address = server.Addr()
+	if !reflect.DeepEqual(info, &expected) {
+		t.Errorf("got %+v, expected %+v", info, &expected)
+	}
+	if info.GameEngine() != valve.SOURCE {
+		t.Errorf("expected a Source server")
+	}
+}
+
+func TestGoldSrcInfo(t *testing.T) {
+	server := NewFakeServer(goldSrcInfo())
+	query := startServer(t, server)
+
+	info, err := query.QueryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ChallengePing != 0 {
+		t.Errorf("expected no challenge, got %v", info.ChallengePing)
+	}
+	info.Ping = 0
+	if !reflect.DeepEqual(info, server.Info) {
+		t.Errorf("got %+v, expected %+v", info, server.Info)
+	}
+}
+
+func TestPing(t *testing.T) {
+	server := NewFakeServer(sourceInfo(valve.App_TF2, 17))
+	server.ChallengeInfo = true
+	server.Latency = time.Millisecond * 50
+	query := startServer(t, server)
+
+	info, err := query.QueryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Ping < server.Latency || info.ChallengePing < server.Latency {
+		t.Errorf("expected round trips of at least %v, got %v and %v", server.Latency, info.Ping, info.ChallengePing)
+	}
+}
+
+func TestGoldSrcExtraInfoPackets(t *testing.T) {
+	server := NewFakeServer(goldSrcInfo())
+	server.Info.Ext = &valve.ExtendedInfo{AppId: valve.App_CS, GameVersion: "1.1.2.7"}
+	server.ExtraInfoPackets = true
+	query := startServer(t, server)
+
+	// We should end up with the newer reply.
+	info, err := query.QueryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.InfoVersion != valve.S2A_INFO_SOURCE {
+		t.Errorf("expected the Source-format reply, got %x", info.InfoVersion)
+	}
+	if info.GameEngine() != valve.GOLDSRC {
+		t.Errorf("expected a GoldSrc server")
+	}
+}
+
+func TestRules(t *testing.T) {
+	cases := []struct {
+		name     string
+		info     *valve.ServerInfo
+		compress bool
+	}{
+		{"source", sourceInfo(valve.App_TF2, 17), false},
+		{"compressed", sourceInfo(valve.App_TF2, 17), true},
+		{"pre-orangebox", sourceInfo(valve.App_CSS, 7), false},
+		{"goldsrc", goldSrcInfo(), false},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			server := NewFakeServer(test.info)
+			server.Rules = manyRules()
+			server.Compress = test.compress
+			if test.info.InfoVersion == valve.S2A_INFO_GOLDSRC {
+				// GoldSrc can only split into 15 packets.
+				server.SplitSize = 1000
+			}
+			query := startServer(t, server)
+
+			if _, err := query.QueryInfo(); err != nil {
+				t.Fatal(err)
+			}
+			rules, err := query.QueryRules()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rules, server.Rules) {
+				t.Errorf("got %d rules, expected %d", len(rules), len(server.Rules))
+			}
+		})
+	}
+}
+
+func TestConfusedChallenges(t *testing.T) {
+	server := NewFakeServer(sourceInfo(valve.App_TF2, 17))
+	server.Rules = map[string]string{"mp_timelimit": "30"}
+	server.ConfusedChallenges = 2
+	query := startServer(t, server)
+
+	rules, err := query.QueryRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules["mp_timelimit"] != "30" {
+		t.Errorf("got rules %v", rules)
+	}
+
+	// Too many confused replies should give up.
+	server2 := NewFakeServer(sourceInfo(valve.App_TF2, 17))
+	server2.ConfusedChallenges = 10
+	query2 := startServer(t, server2)
+
+	_, err = query2.QueryRules()
+	if !errors.Is(err, valve.ErrConfusedChallengeReply) {
+		t.Errorf("expected ErrConfusedChallengeReply, got %v", err)
+	}
+	var queryErr *valve.QueryError
+	if !errors.As(err, &queryErr) || queryErr.Phase != valve.Phase_Challenge || !queryErr.Retryable {
+		t.Errorf("expected a retryable challenge error, got %#v", err)
+	}
+}
+
+func TestPlayers(t *testing.T) {
+	info := sourceInfo(valve.App_TheShip, 7)
+	info.TheShip = &valve.TheShipInfo{Mode: 1, Witnesses: 2, Duration: 3}
+	server := NewFakeServer(info)
+	server.Players = []*valve.PlayerInfo{
+		{Index: 0, Name: "Sailor", Score: 4, Duration: 60.5, TheShip: &valve.TheShipPlayerInfo{Deaths: 1, Money: 500}},
+		{Index: 1, Name: "Captain", Score: -1, Duration: 2.25, TheShip: &valve.TheShipPlayerInfo{Deaths: 3, Money: 10}},
+	}
+	query := startServer(t, server)
+
+	if _, err := query.QueryInfo(); err != nil {
+		t.Fatal(err)
+	}
+	players, err := query.QueryPlayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(players, server.Players) {
+		t.Errorf("got %+v, expected %+v", players, server.Players)
+	}
+}
+
+func dropRequests(requests ...int) func(int) bool {
+	return func(request int) bool {
+		for _, n := range requests {
+			if n == request {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestRetries(t *testing.T) {
+	policy := valve.RetryPolicy{Attempts: 3, Timeout: time.Millisecond * 100}
+
+	server := NewFakeServer(sourceInfo(valve.App_TF2, 17))
+	server.Drop = dropRequests(1, 2)
+	query := startServer(t, server)
+	query.SetRetryPolicy(policy)
+
+	if _, err := query.QueryInfo(); err != nil {
+		t.Errorf("expected the third attempt to succeed, got %v", err)
+	}
+
+	// Without enough attempts, the query times out.
+	server = NewFakeServer(sourceInfo(valve.App_TF2, 17))
+	server.Drop = dropRequests(1, 2, 3)
+	query = startServer(t, server)
+	query.SetRetryPolicy(policy)
+
+	_, err := query.QueryInfo()
+	var queryErr *valve.QueryError
+	if !errors.As(err, &queryErr) || queryErr.Phase != valve.Phase_Info || queryErr.Code != "timeout" {
+		t.Errorf("expected an info timeout, got %v", err)
+	}
+	if server.Requests() != 3 {
+		t.Errorf("expected 3 attempts, got %d", server.Requests())
+	}
+}
+
+func TestPingAfterRetry(t *testing.T) {
+	// The reply to the first attempt arrives while waiting for the second,
+	// so the ping must include the time before the retry.
+	server := NewFakeServer(sourceInfo(valve.App_TF2, 17))
+	server.Latency = time.Millisecond * 150
+	query := startServer(t, server)
+	query.SetRetryPolicy(valve.RetryPolicy{Attempts: 2, Timeout: time.Millisecond * 100})
+
+	info, err := query.QueryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Ping < server.Latency {
+		t.Errorf("expected a round trip of at least %v, got %v", server.Latency, info.Ping)
+	}
+}
+
+func TestLateChallengeAfterRetry(t *testing.T) {
+	// Each challenge request is sent twice, so a second S2C_CHALLENGE arrives
+	// after the challenged request has been sent. It must not be mistaken for
+	// the reply.
+	server := NewFakeServer(sourceInfo(valve.App_TF2, 17))
+	server.ChallengeInfo = true
+	server.Latency = time.Millisecond * 150
+	server.Rules = map[string]string{"mp_timelimit": "30"}
+	server.Players = []*valve.PlayerInfo{{Index: 0, Name: "Scout", Score: 10, Duration: 12.5}}
+	query := startServer(t, server)
+	query.SetRetryPolicy(valve.RetryPolicy{Attempts: 2, Timeout: time.Millisecond * 100})
+
+	info, err := query.QueryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != server.Info.Name {
+		t.Errorf("got name %q, expected %q", info.Name, server.Info.Name)
+	}
+	rules, err := query.QueryRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules["mp_timelimit"] != "30" {
+		t.Errorf("got rules %v", rules)
+	}
+	players, err := query.QueryPlayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(players) != 1 || players[0].Name != "Scout" {
+		t.Errorf("got players %+v", players)
+	}
+}
+
+func TestRetriesPerExchange(t *testing.T) {
+	// Each exchange gets its own attempts: losing the first challenge request
+	// and the first challenged request needs only two attempts each.
+	server := NewFakeServer(sourceInfo(valve.App_TF2, 17))
+	server.ChallengeInfo = true
+	server.Rules = map[string]string{"mp_timelimit": "30"}
+	server.Drop = dropRequests(1, 3, 5, 7)
+	query := startServer(t, server)
+	query.SetRetryPolicy(valve.RetryPolicy{Attempts: 2, Timeout: time.Millisecond * 100})
+
+	if _, err := query.QueryInfo(); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := query.QueryRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules["mp_timelimit"] != "30" {
+		t.Errorf("got rules %v", rules)
+	}
+}
+
+func TestSharedSocket(t *testing.T) {
+	shared, err := valve.NewSharedUdpSocket(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shared.Close()
+
+	servers := []*FakeServer{
+		NewFakeServer(sourceInfo(valve.App_TF2, 17)),
+		NewFakeServer(sourceInfo(valve.App_CSS, 17)),
+	}
+	for i, server := range servers {
+		server.Info.Name = fmt.Sprintf("Server %d", i)
+		server.Rules = manyRules()
+		server.ChallengeInfo = true
+		if err := server.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+	}
+
+	// Query both servers at once, over and over, through the same socket.
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go (func(server *FakeServer) {
+			for i := 0; i < 20; i++ {
+				socket, err := shared.Dial(server.Addr(), kTimeout)
+				if err != nil {
+					errs <- err
+					return
+				}
+				query := valve.NewServerQuerierFromSocket(socket, kTimeout)
+
+				info, err := query.QueryInfo()
+				if err == nil && info.Name != server.Info.Name {
+					err = fmt.Errorf("expected %q, got a reply from %q", server.Info.Name, info.Name)
+				}
+				if err == nil {
+					var rules map[string]string
+					if rules, err = query.QueryRules(); err == nil && !reflect.DeepEqual(rules, server.Rules) {
+						err = fmt.Errorf("got %d rules, expected %d", len(rules), len(server.Rules))
+					}
+				}
+				query.Close()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		})(server)
+	}
+
+	for range servers {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}